@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessLogConfig configures the access logs: one JSON record per request
+type AccessLogConfig struct {
+	Enabled    bool
+	File       string  // default: stdout
+	SampleRate float64 // share of the successful requests logged, default 1; the errors are always logged
+}
+
+// accessLogger writes the access logs, nil if they are disabled
+var (
+	accessLogger  *log.Logger
+	accessLogFile *accessLogWriter
+)
+
+// accessLogWriter writes to the file of the access logs until it is closed, then drops the
+// writes: the requests cut at the shutdown deadline may still be logged after it
+type accessLogWriter struct {
+	mu   sync.Mutex
+	file *os.File // nil once closed
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return len(p), nil
+	}
+	return w.file.Write(p)
+}
+
+func (w *accessLogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func initAccessLog() {
+	cfg := config.AccessLog
+	if !cfg.Enabled {
+		return
+	}
+	accessLogger = log.New()
+	accessLogger.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	if cfg.File != "" {
+		file, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			log.Fatalf("Cannot open the access log: %v\n", err)
+		}
+		accessLogFile = &accessLogWriter{file: file}
+		accessLogger.SetOutput(accessLogFile)
+	} else {
+		accessLogger.SetOutput(os.Stdout)
+	}
+}
+
+// closeAccessLog closes the file of the access logs, once the last request is served
+func closeAccessLog() {
+	if accessLogFile == nil {
+		return
+	}
+	if err := accessLogFile.Close(); err != nil {
+		log.Errorf("Cannot close the access log: %v\n", err)
+	}
+}
+
+// sampled tells if the access log of a request is written
+func sampled(code int) bool {
+	rate := config.AccessLog.SampleRate
+	return code >= http.StatusBadRequest || rate <= 0 || rate >= 1 || rand.Float64() < rate
+}
+
+// logAccess writes the access log of a request. The RPC calls of a fetch shared by identical
+// requests are counted for the request which made it.
+func logAccess(req *http.Request, info *requestInfo, code int, bytes int64, duration time.Duration) {
+	if accessLogger == nil || !sampled(code) {
+		return
+	}
+	ip := ""
+	if clientIP := clientIP(req); clientIP != nil {
+		ip = clientIP.String()
+	}
+	fields := log.Fields{
+		"requestId":   info.requestId,
+		"method":      req.Method,
+		"host":        req.Host,
+		"path":        req.URL.RequestURI(),
+		"clientIp":    ip,
+		"web3Url":     info.web3Url,
+		"chain":       info.chain,
+		"contract":    info.contract,
+		"resolveMode": info.resolveMode,
+		"status":      code,
+		"bytes":       bytes,
+		"durationMs":  float64(duration.Microseconds()) / 1000,
+		"cacheStatus": info.cacheStatus,
+		"rpcCalls":    atomic.LoadUint64(&info.rpcCalls),
+	}
+	if info.traceId != "" {
+		fields["traceId"] = info.traceId
+	}
+	accessLogger.WithFields(fields).Info("request")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLog(t *testing.T) {
+	defer func(logger *log.Logger) { accessLogger = logger }(accessLogger)
+	out := &bytes.Buffer{}
+	accessLogger = log.New()
+	accessLogger.SetFormatter(&log.JSONFormatter{})
+	accessLogger.SetOutput(out)
+
+	handler := instrument(func(w http.ResponseWriter, req *http.Request) {
+		info := getRequestInfo(req)
+		info.web3Url, info.chain, info.contract, info.resolveMode, info.cacheStatus = "web3://vitalik.eth/", "1", "0xd8dA6BF26964aF9D7eEd9e03E53415D37aA96045", "auto", "MISS"
+		atomic.AddUint64(&info.rpcCalls, 2)
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	// The request ID of the proxy is propagated
+	req := httptest.NewRequest("GET", "http://vitalik.eth.1.w3link.io/index.html?a=1", nil)
+	req.Header.Set("X-Request-ID", "lb-1234")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, "lb-1234", w.Header().Get("X-Request-ID"))
+	var record map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, "lb-1234", record["requestId"])
+	assert.Equal(t, "vitalik.eth.1.w3link.io", record["host"])
+	assert.Equal(t, "/index.html?a=1", record["path"])
+	assert.Equal(t, "web3://vitalik.eth/", record["web3Url"])
+	assert.Equal(t, "0xd8dA6BF26964aF9D7eEd9e03E53415D37aA96045", record["contract"])
+	assert.Equal(t, float64(200), record["status"])
+	assert.Equal(t, float64(5), record["bytes"])
+	assert.Equal(t, "MISS", record["cacheStatus"])
+	assert.Equal(t, float64(2), record["rpcCalls"])
+
+	// Or generated
+	req.Header.Set("X-Request-ID", "not a valid id")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Len(t, w.Header().Get("X-Request-ID"), 32)
+}
+
+func TestAccessLogWriterClose(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "access.log"))
+	assert.NoError(t, err)
+	writer := &accessLogWriter{file: file}
+	_, err = writer.Write([]byte("logged\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	// The writes after the close are dropped
+	n, err := writer.Write([]byte("dropped\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+	assert.NoError(t, writer.Close())
+	data, err := os.ReadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "logged\n", string(data))
+}
@@ -23,7 +23,16 @@ func (c *ExtendCache) Get(ctx context.Context, name string) ([]byte, error) {
 }
 
 func (c *ExtendCache) Put(ctx context.Context, name string, data []byte) error {
-	return c.DirCache.Put(ctx, name, data)
+	err := c.DirCache.Put(ctx, name, data)
+	// The certificates are stored by domain, after their issuance; the ACME account key as well
+	if !strings.HasPrefix(name, "acme_account") {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		certificatesStored.inc(result)
+	}
+	return err
 }
 
 func (c *ExtendCache) Delete(ctx context.Context, name string) error {
@@ -134,5 +143,9 @@ func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	if cert, err := tryFindSystemCertificate(hello.ServerName); err == nil && cert != nil {
 		return cert, nil
 	}
-	return certManager.GetCertificate(hello)
+	cert, err := certManager.GetCertificate(hello)
+	if err != nil {
+		certificateErrors.inc()
+	}
+	return cert, err
 }
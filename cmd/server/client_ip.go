@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks of the proxies in front of the gateway (load balancers, CDN),
+// whose Forwarded, X-Forwarded-For and X-Real-IP headers are honored
+var trustedProxies []*net.IPNet
+
+// parseCIDRs parses a list of networks, e.g. ["10.0.0.0/8", "2001:db8::/32", "192.0.2.1"].
+// A single IP is a network of one address.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %v", cidr)
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateTrustedProxies() error {
+	networks, err := parseCIDRs(config.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("TrustedProxies: %v", err)
+	}
+	trustedProxies = networks
+	return nil
+}
+
+// clientIP returns the IP of the client of a request: the peer of the connection, or if it is a
+// trusted proxy, the last address forwarded by the proxies which is not a trusted proxy.
+// The forwarded addresses are the ones of the Forwarded header (RFC 7239), or else of
+// X-Forwarded-For, or else of X-Real-IP. It returns nil if the address of the peer is unknown.
+func clientIP(req *http.Request) net.IP {
+	ip := peerIP(req)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return ip
+	}
+	// Each proxy appends the address of its peer: the client is the first one from the right
+	// which is not one of our proxies
+	forwarded := forwardedAddresses(req.Header)
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := parseForwardedIP(forwarded[i])
+		if forwardedIP == nil {
+			// Unknown or obfuscated: the addresses on the left cannot be trusted
+			break
+		}
+		ip = forwardedIP
+		if !containsIP(trustedProxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// peerIP returns the IP of the peer of the connection of a request, or nil if it is unknown
+func peerIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// fromTrustedProxy tells if a request is sent by one of the trusted proxies
+func fromTrustedProxy(req *http.Request) bool {
+	ip := peerIP(req)
+	return ip != nil && containsIP(trustedProxies, ip)
+}
+
+// forwardedAddresses returns the addresses of the client and the proxies of a request, from the
+// leftmost (the client) to the last proxy
+func forwardedAddresses(header http.Header) []string {
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		// e.g. Forwarded: for=192.0.2.60;proto=https, for="[2001:db8:cafe::17]:4711"
+		var addresses []string
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			address := ""
+			for _, pair := range strings.Split(element, ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(name, "for") {
+					address = value
+				}
+			}
+			addresses = append(addresses, address)
+		}
+		return addresses
+	}
+	if values := header.Values("X-Forwarded-For"); len(values) > 0 {
+		return strings.Split(strings.Join(values, ","), ",")
+	}
+	if value := header.Get("X-Real-IP"); value != "" {
+		return []string{value}
+	}
+	return nil
+}
+
+// parseForwardedIP parses a forwarded address, which may be quoted and have a port,
+// e.g. 192.0.2.60, "192.0.2.60:4711" or "[2001:db8:cafe::17]:4711"
+func parseForwardedIP(address string) net.IP {
+	address = strings.Trim(strings.TrimSpace(address), `"`)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return net.ParseIP(strings.Trim(address, "[]"))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(proxies []string) {
+		config.TrustedProxies = proxies
+		_ = validateTrustedProxies()
+	}(config.TrustedProxies)
+	config.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::1"}
+	assert.NoError(t, validateTrustedProxies())
+
+	tests := []struct {
+		remoteAddr string
+		header     http.Header
+		expect     string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "192.0.2.1"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9", "198.51.100.1"}}, "198.51.100.1"},
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1, unknown"}}, "10.0.0.1"},
+		{"[2001:db8::1]:1234", http.Header{"X-Forwarded-For": {"2001:db8::2"}}, "2001:db8::2"},
+		{"10.0.0.1:1234", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"10.0.0.1:1234", http.Header{"Forwarded": {`for=198.51.100.1;proto=https, for="10.0.0.2:4711"`}}, "198.51.100.1"},
+		{"10.0.0.1:1234", http.Header{"Forwarded": {`For="[2001:db8:cafe::17]:4711"`}}, "2001:db8:cafe::17"},
+		{"10.0.0.1:1234", http.Header{"Forwarded": {"for=_hidden, for=10.0.0.2"}}, "10.0.0.2"},
+		// Forwarded first, then X-Forwarded-For
+		{"10.0.0.1:1234", http.Header{"Forwarded": {"for=198.51.100.1"}, "X-Forwarded-For": {"203.0.113.9"}}, "198.51.100.1"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header = test.header
+		assert.Equal(t, test.expect, clientIP(req).String(), test.remoteAddr, test.header)
+	}
+
+	config.TrustedProxies = []string{"10.0.0.0/33"}
+	assert.Error(t, validateTrustedProxies())
+}
+
+func TestRequestScheme(t *testing.T) {
+	defer func(proxies []string) {
+		config.TrustedProxies = proxies
+		_ = validateTrustedProxies()
+	}(config.TrustedProxies)
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	assert.NoError(t, validateTrustedProxies())
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	assert.Equal(t, "http", requestScheme(req))
+	req.Header.Set("X-Forwarded-Proto", "https")
+	assert.Equal(t, "http", requestScheme(req), "not sent by a trusted proxy")
+	req.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "https", requestScheme(req))
+	req.Header.Set("X-Forwarded-Proto", "ftp")
+	assert.Equal(t, "http", requestScheme(req))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/web3-protocol/web3protocol-go"
+)
+
+// ClientRateLimitConfig configures the rate limits of the clients, by IP and by subnet (/24 for
+// IPv4, /64 for IPv6). Each limit is a token bucket: a rate of requests per second, with a burst.
+type ClientRateLimitConfig struct {
+	Rate        float64  // requests per second of an IP; 0 for no limit
+	Burst       int      // default: Rate
+	SubnetRate  float64  // requests per second of a subnet; 0 for no limit
+	SubnetBurst int      // default: SubnetRate
+	Allowlist   []string // IPs and networks not limited, e.g. our own infrastructure
+	MaxClients  int      // max number of IPs and subnets tracked; the least recently seen are forgotten
+}
+
+const defaultClientRateLimitMaxClients = 100000
+
+// clientBucket is the token bucket of an IP or a subnet
+type clientBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// clientLimiter limits the requests of the clients, with a bounded number of buckets
+type clientLimiter struct {
+	rate        float64
+	burst       float64
+	subnetRate  float64
+	subnetBurst float64
+	allowlist   []*net.IPNet
+	maxClients  int
+	now         func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element // of *clientBucket
+	lru     *list.List               // most recently seen first
+	stats   clientLimiterStats
+}
+
+type clientLimiterStats struct {
+	Clients   int    `json:"clients"` // IPs and subnets tracked
+	Allowed   uint64 `json:"allowed"`
+	Throttled uint64 `json:"throttled"`
+}
+
+// burstOr returns the burst of a token bucket, by default its rate
+func burstOr(burst int, rate float64) float64 {
+	if burst > 0 {
+		return float64(burst)
+	}
+	return math.Max(1, math.Ceil(rate))
+}
+
+func newClientLimiter(cfg ClientRateLimitConfig) (*clientLimiter, error) {
+	allowlist, err := parseCIDRs(cfg.Allowlist)
+	if err != nil {
+		return nil, fmt.Errorf("clientRateLimit.Allowlist: %v", err)
+	}
+	l := &clientLimiter{
+		rate:        cfg.Rate,
+		burst:       burstOr(cfg.Burst, cfg.Rate),
+		subnetRate:  cfg.SubnetRate,
+		subnetBurst: burstOr(cfg.SubnetBurst, cfg.SubnetRate),
+		allowlist:   allowlist,
+		maxClients:  cfg.MaxClients,
+		now:         time.Now,
+		buckets:     map[string]*list.Element{},
+		lru:         list.New(),
+	}
+	if l.maxClients <= 0 {
+		l.maxClients = defaultClientRateLimitMaxClients
+	}
+	return l, nil
+}
+
+// subnet returns the /24 of an IPv4 address, or the /64 of an IPv6 address
+func subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// bucket returns the bucket of a key, refilled, creating it if needed
+func (l *clientLimiter) bucket(key string, rate float64, burst float64, now time.Time) *clientBucket {
+	if element, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(element)
+		b := element.Value.(*clientBucket)
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+		return b
+	}
+	b := &clientBucket{key: key, tokens: burst, last: now}
+	l.buckets[key] = l.lru.PushFront(b)
+	for l.lru.Len() > l.maxClients {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*clientBucket).key)
+	}
+	return b
+}
+
+// allow tells if a client IP may send a request now, or else when to retry. A request takes a
+// token from the bucket of the IP, and from the one of its subnet.
+func (l *clientLimiter) allow(ip net.IP) (time.Duration, bool) {
+	if ip == nil || containsIP(l.allowlist, ip) {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var buckets []*clientBucket
+	wait := time.Duration(0)
+	for _, limit := range []struct {
+		key         string
+		rate, burst float64
+	}{{"ip " + ip.String(), l.rate, l.burst}, {"subnet " + subnet(ip), l.subnetRate, l.subnetBurst}} {
+		if limit.rate <= 0 {
+			continue
+		}
+		b := l.bucket(limit.key, limit.rate, limit.burst, now)
+		if b.tokens < 1 {
+			if bucketWait := time.Duration((1 - b.tokens) / limit.rate * float64(time.Second)); bucketWait > wait {
+				wait = bucketWait
+			}
+		}
+		buckets = append(buckets, b)
+	}
+	if wait > 0 {
+		l.stats.Throttled++
+		return wait, false
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	l.stats.Allowed++
+	return 0, true
+}
+
+func (l *clientLimiter) getStats() clientLimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.Clients = l.lru.Len()
+	return stats
+}
+
+// clientLimits is the rate limiter of the clients, nil if there is no limit
+var clientLimits *clientLimiter
+
+func initClientLimiter() {
+	cfg := config.ClientRateLimit
+	if cfg.Rate <= 0 && cfg.SubnetRate <= 0 {
+		return
+	}
+	limiter, err := newClientLimiter(cfg)
+	if err != nil {
+		log.Fatalf("Invalid config: %v\n", err)
+	}
+	clientLimits = limiter
+}
+
+// checkClientRateLimit answers 429 to a request over the rate limit of its client, and tells if
+// the request can be served
+func checkClientRateLimit(w http.ResponseWriter, req *http.Request) bool {
+	if clientLimits == nil {
+		return true
+	}
+	wait, ok := clientLimits.allow(clientIP(req))
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", retryAfterSeconds(wait))
+	respondWithErrorPage(w, &web3protocol.ErrorWithHttpCode{HttpCode: http.StatusTooManyRequests, Err: "too many requests, retry later"})
+	return false
+}
+
+// handleClientRateLimitStats serves the stats of the rate limiter of the clients
+func handleClientRateLimitStats(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	stats := clientLimiterStats{}
+	if clientLimits != nil {
+		stats = clientLimits.getStats()
+	}
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Errorf("Cannot write client rate limit stats: %v\n", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientLimiter(t *testing.T) {
+	limiter, err := newClientLimiter(ClientRateLimitConfig{Rate: 1, Burst: 2, SubnetRate: 1, SubnetBurst: 3, Allowlist: []string{"10.0.0.0/8"}, MaxClients: 4})
+	assert.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	allow := func(ip string) bool {
+		_, ok := limiter.allow(net.ParseIP(ip))
+		return ok
+	}
+
+	// The burst of an IP, then one request per second
+	assert.True(t, allow("192.0.2.1"))
+	assert.True(t, allow("192.0.2.1"))
+	wait, ok := limiter.allow(net.ParseIP("192.0.2.1"))
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+	now = now.Add(time.Second)
+	assert.True(t, allow("192.0.2.1"))
+
+	// The burst of the /24 subnet is shared by its IPs
+	assert.True(t, allow("192.0.2.2"))
+	assert.False(t, allow("192.0.2.3"))
+	assert.True(t, allow("198.51.100.1"))
+
+	// IPv6: /64 subnets
+	assert.True(t, allow("2001:db8::1"))
+	assert.True(t, allow("2001:db8::2"))
+	assert.True(t, allow("2001:db8::3"))
+	assert.False(t, allow("2001:db8::4"))
+	assert.True(t, allow("2001:db8:0:1::1"))
+
+	// Allowlist
+	for i := 0; i < 10; i++ {
+		assert.True(t, allow("10.1.2.3"))
+	}
+
+	// The number of buckets is bounded
+	stats := limiter.getStats()
+	assert.Equal(t, 4, stats.Clients)
+	assert.Equal(t, uint64(3), stats.Throttled)
+}
+
+func TestCheckClientRateLimit(t *testing.T) {
+	defer func(limits *clientLimiter, proxies []*net.IPNet) {
+		clientLimits, trustedProxies = limits, proxies
+	}(clientLimits, trustedProxies)
+	trustedProxies, _ = parseCIDRs([]string{"10.0.0.0/8"})
+	clientLimits, _ = newClientLimiter(ClientRateLimitConfig{Rate: 0.5, Burst: 1})
+
+	request := func(remoteAddr string, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		if checkClientRateLimit(w, req) {
+			w.WriteHeader(http.StatusOK)
+		}
+		return w
+	}
+	assert.Equal(t, http.StatusOK, request("10.0.0.1:1234", "192.0.2.1").Code)
+	w := request("10.0.0.2:1234", "192.0.2.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+	// X-Forwarded-For is ignored from the other peers
+	assert.Equal(t, http.StatusOK, request("198.51.100.1:1234", "192.0.2.2").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("198.51.100.1:1234", "192.0.2.3").Code)
+}
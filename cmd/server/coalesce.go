@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The gateway always reads the contracts at the latest block, so identical web3:// URLs fetched
+// at the same time give the same response
+const blockTagLatest = "latest"
+
+// coalesceMaxBufferBytes bounds the part of a shared body read from upstream but not by every
+// request yet: past it, the upstream read waits for the slowest request
+const coalesceMaxBufferBytes = 1 << 20
+
+// fetchGroup collapses the concurrent fetches of the same web3:// URL into one upstream fetch.
+// The requests arriving until its headers are fetched share it. Its body is read once, and each
+// request receives its own copy of it while it is streamed.
+type fetchGroup struct {
+	mu    sync.Mutex
+	calls map[string]*sharedFetch
+	stats fetchGroupStats
+}
+
+// fetchGroupStats are the metrics of a fetchGroup
+type fetchGroupStats struct {
+	Fetches   uint64 `json:"fetches"`
+	Coalesced uint64 `json:"coalesced"`
+	InFlight  int    `json:"inFlight"`
+}
+
+// sharedFetch is a fetch in progress. Its body is kept in memory until every reader has read it,
+// and its upstream read stops once every reader is closed.
+type sharedFetch struct {
+	done chan struct{} // closed once the response headers are fetched
+	resp *web3Response
+	err  error
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	readers map[*sharedBodyReader]bool // the open readers
+	body    []byte                     // the body from offset start, not read by every reader yet
+	start   int
+	bodyErr error // io.EOF once the body has been read entirely
+}
+
+func newFetchGroup() *fetchGroup {
+	return &fetchGroup{calls: make(map[string]*sharedFetch)}
+}
+
+var inflightFetches = newFetchGroup()
+
+// coalesceKey returns the key of the fetches of a web3:// URL which can be shared
+func coalesceKey(web3Url string) string {
+	return normalizeWeb3Url(web3Url) + "@" + blockTagLatest
+}
+
+// do returns the response of fn, shared with the concurrent calls of the same key. The returned
+// response has its own headers and body reader, which must be closed.
+func (g *fetchGroup) do(ctx context.Context, key string, fn func() (*web3Response, error)) (*web3Response, error) {
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if ok {
+		g.stats.Coalesced++
+		reader := call.newReader()
+		g.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			_ = reader.Close()
+			return nil, ctx.Err()
+		}
+		if call.err != nil {
+			return nil, call.err
+		}
+		return call.newResponse(reader), nil
+	}
+	call = &sharedFetch{done: make(chan struct{}), readers: make(map[*sharedBodyReader]bool)}
+	call.cond = sync.NewCond(&call.mu)
+	reader := call.newReader()
+	g.calls[key] = call
+	g.stats.Fetches++
+	g.mu.Unlock()
+
+	call.resp, call.err = fn()
+	// The later requests fetch again, rather than waiting for the body from its beginning
+	g.forget(key)
+	if call.err != nil {
+		close(call.done)
+		return nil, call.err
+	}
+	body := call.resp.body
+	call.resp.body = nil
+	close(call.done)
+
+	// The body is read even if the client of this request goes away, for the other ones
+	go call.copyBody(body)
+	return call.newResponse(reader), nil
+}
+
+func (g *fetchGroup) forget(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.calls, key)
+}
+
+// getStats returns a snapshot of the metrics of the group
+func (g *fetchGroup) getStats() fetchGroupStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	stats := g.stats
+	stats.InFlight = len(g.calls)
+	return stats
+}
+
+// copyBody reads the upstream body, and wakes up the readers of the copies after each chunk. It
+// waits while coalesceMaxBufferBytes are not read by every reader, and stops once they are all
+// closed.
+func (f *sharedFetch) copyBody(r io.ReadCloser) {
+	defer r.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		f.mu.Lock()
+		for len(f.body) >= coalesceMaxBufferBytes && len(f.readers) > 0 {
+			f.cond.Wait()
+		}
+		closed := len(f.readers) == 0
+		f.mu.Unlock()
+		if closed {
+			return
+		}
+
+		n, err := r.Read(buf)
+		f.mu.Lock()
+		f.body = append(f.body, buf[:n]...)
+		if err != nil {
+			f.bodyErr = err
+		}
+		f.mu.Unlock()
+		f.cond.Broadcast()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// newReader returns a reader of the shared body, starting at its beginning
+func (f *sharedFetch) newReader() *sharedBodyReader {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reader := &sharedBodyReader{f: f}
+	f.readers[reader] = true
+	return reader
+}
+
+// trim drops the part of the body read by every reader. f.mu must be held.
+func (f *sharedFetch) trim() {
+	end := f.start + len(f.body)
+	for reader := range f.readers {
+		if reader.off < end {
+			end = reader.off
+		}
+	}
+	if end > f.start {
+		f.body = f.body[end-f.start:]
+		f.start = end
+		f.cond.Broadcast()
+	}
+}
+
+// newResponse returns a copy of the shared response, with the given body reader
+func (f *sharedFetch) newResponse(reader *sharedBodyReader) *web3Response {
+	resp := *f.resp
+	resp.header = f.resp.header.Clone()
+	resp.body = reader
+	return &resp
+}
+
+// sharedBodyReader reads the body of a sharedFetch, waiting for the chunks not fetched yet
+type sharedBodyReader struct {
+	f   *sharedFetch
+	off int
+}
+
+func (r *sharedBodyReader) Read(p []byte) (int, error) {
+	r.f.mu.Lock()
+	defer r.f.mu.Unlock()
+	for r.f.readers[r] && r.off >= r.f.start+len(r.f.body) && r.f.bodyErr == nil {
+		r.f.cond.Wait()
+	}
+	if !r.f.readers[r] {
+		return 0, io.ErrClosedPipe
+	}
+	if r.off < r.f.start+len(r.f.body) {
+		n := copy(p, r.f.body[r.off-r.f.start:])
+		r.off += n
+		r.f.trim()
+		return n, nil
+	}
+	return 0, r.f.bodyErr
+}
+
+func (r *sharedBodyReader) Close() error {
+	r.f.mu.Lock()
+	defer r.f.mu.Unlock()
+	delete(r.f.readers, r)
+	r.f.trim()
+	// Wakes up copyBody if it waits for this reader
+	r.f.cond.Broadcast()
+	return nil
+}
+
+// handleFetchCoalescingStats serves the metrics of the coalescing of the fetches
+func handleFetchCoalescingStats(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(inflightFetches.getStats()); err != nil {
+		log.Errorf("Cannot write fetch coalescing stats: %v\n", err)
+	}
+}
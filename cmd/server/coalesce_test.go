@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchGroupCoalesces(t *testing.T) {
+	group := newFetchGroup()
+	body, bodyWriter := io.Pipe()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fetches := 0
+	fetch := func() (*web3Response, error) {
+		fetches++
+		close(started)
+		<-release
+		return &web3Response{httpCode: 200, header: http.Header{"Content-Type": {"text/html"}}, body: body}, nil
+	}
+
+	const requests = 10
+	var wg sync.WaitGroup
+	bodies := make([]string, requests)
+	headers := make([]http.Header, requests)
+	do := func(i int) {
+		defer wg.Done()
+		resp, err := group.do(context.Background(), "index.html", fetch)
+		assert.NoError(t, err)
+		headers[i] = resp.header
+		data, err := io.ReadAll(resp.body)
+		assert.NoError(t, err)
+		bodies[i] = string(data)
+	}
+	wg.Add(1)
+	go do(0)
+	<-started
+	for i := 1; i < requests; i++ {
+		wg.Add(1)
+		go do(i)
+	}
+	for group.getStats().Coalesced < requests-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	// The body is streamed to every request
+	for i := 0; i < 3; i++ {
+		_, err := fmt.Fprintf(bodyWriter, "chunk %d;", i)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, bodyWriter.Close())
+	wg.Wait()
+
+	assert.Equal(t, 1, fetches)
+	for i := 0; i < requests; i++ {
+		assert.Equal(t, "chunk 0;chunk 1;chunk 2;", bodies[i])
+		assert.Equal(t, "text/html", headers[i].Get("Content-Type"))
+	}
+	// Each request has its own headers
+	headers[0].Set("Content-Type", "text/plain")
+	assert.Equal(t, "text/html", headers[1].Get("Content-Type"))
+
+	// Once done, a new request fetches again
+	for group.getStats().InFlight > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err := group.do(context.Background(), "index.html", func() (*web3Response, error) {
+		fetches++
+		return nil, fmt.Errorf("rpc error")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 2, fetches)
+	assert.Equal(t, fetchGroupStats{Fetches: 2, Coalesced: requests - 1}, group.getStats())
+}
+
+// endlessBody is an upstream body which never ends
+type endlessBody struct {
+	mu     sync.Mutex
+	read   int
+	closed bool
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.read += len(p)
+	return len(p), nil
+}
+
+func (b *endlessBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+func (b *endlessBody) state() (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.read, b.closed
+}
+
+func TestFetchGroupBoundsBody(t *testing.T) {
+	group := newFetchGroup()
+	body := &endlessBody{}
+	release := make(chan struct{})
+	fetch := func() (*web3Response, error) {
+		<-release
+		return &web3Response{httpCode: 200, header: http.Header{}, body: body}, nil
+	}
+
+	responses := make(chan *web3Response, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := group.do(context.Background(), "large.bin", fetch)
+			assert.NoError(t, err)
+			responses <- resp
+		}()
+	}
+	for group.getStats().Coalesced < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	fast, slow := <-responses, <-responses
+
+	// The key is forgotten once the headers are fetched
+	assert.Equal(t, 0, group.getStats().InFlight)
+
+	// The upstream read waits for the slowest reader
+	go func() {
+		_, err := io.Copy(io.Discard, fast.body)
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+	}()
+	for read, _ := body.state(); read < coalesceMaxBufferBytes; read, _ = body.state() {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	read, _ := body.state()
+	assert.LessOrEqual(t, read, coalesceMaxBufferBytes+32*1024)
+
+	// It goes on without the slow reader once it is closed, and stops once every reader is closed
+	assert.NoError(t, slow.body.Close())
+	for read, _ := body.state(); read < 2*coalesceMaxBufferBytes; read, _ = body.state() {
+		time.Sleep(time.Millisecond)
+	}
+	assert.NoError(t, fast.body.Close())
+	for _, closed := body.state(); !closed; _, closed = body.state() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	assert.Equal(t, coalesceKey("web3://quark.w3q:3334/index.txt"), coalesceKey("web3://Quark.W3Q:w3q-g/index.txt"))
+	assert.NotEqual(t, coalesceKey("web3://quark.w3q:3334/index.txt"), coalesceKey("web3://quark.w3q:3334/index.txt?a=1"))
+}
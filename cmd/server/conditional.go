@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Responses without ETag whose body is at most this large are buffered to compute one
+const defaultETagMaxBodyBytes = 1 << 20
+
+// etagFromHash returns a strong ETag from the hash of a body
+func etagFromHash(h hash.Hash) string {
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// bodyETag returns a strong ETag from a body
+func bodyETag(body []byte) string {
+	h := sha256.New()
+	h.Write(body)
+	return etagFromHash(h)
+}
+
+// patchedETag returns the ETag of a HTML page patched by the gateway, which differs from the one
+// of the page returned by the contract. When the web3:// links of the page are rewritten, the
+// page also depends on the gateway URL they point to (linkBase, e.g. https://w3link.io), whose
+// hash is added to the ETag.
+// e.g. "abc" -> "abc-web3", W/"abc" -> W/"abc-web3", "abc" + https://w3link.io -> "abc-web3-f8c54730"
+func patchedETag(etag string, linkBase string) string {
+	if !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	suffix := "-web3"
+	if linkBase != "" {
+		h := sha256.Sum256([]byte(linkBase))
+		suffix += "-" + hex.EncodeToString(h[:4])
+	}
+	return etag[:len(etag)-1] + suffix + `"`
+}
+
+// addETag sets the ETag of a response returned without one, if its body is small enough to be
+// buffered. The body is read up to maxBytes, then replaced by a reader of the whole body. The
+// bodies of unknown size are only buffered for the conditional requests, so that the first bytes
+// of the other responses are not delayed.
+func addETag(resp *web3Response, maxBytes int64, conditional bool) error {
+	if resp.header.Get("ETag") != "" || resp.httpCode != http.StatusOK {
+		return nil
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultETagMaxBodyBytes
+	}
+	if size := bodySize(resp); size > maxBytes || (size < 0 && !conditional) {
+		return nil
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(resp.body, maxBytes+1))
+	if err != nil {
+		return err
+	}
+	if n > maxBytes {
+		// Too large: stream it without ETag
+		resp.body = readCloser{io.MultiReader(&buf, resp.body), resp.body}
+		return nil
+	}
+	resp.header.Set("ETag", bodyETag(buf.Bytes()))
+	resp.body = readSeekCloser{bytes.NewReader(buf.Bytes()), resp.body}
+	return nil
+}
+
+// readCloser reads from a reader, and closes a closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// readSeekCloser reads from a seekable reader, and closes a closer
+type readSeekCloser struct {
+	io.ReadSeeker
+	io.Closer
+}
+
+// isNotModified tells if a conditional GET or HEAD request can be answered with a 304, given the
+// headers of the response (RFC 9110, section 13.2.2)
+func isNotModified(req *http.Request, header http.Header) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, header.Get("ETag"))
+	}
+	ifModifiedSince, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(ifModifiedSince)
+}
+
+// etagMatches tells if an ETag is in the list of an If-None-Match header, using the weak
+// comparison
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified answers a conditional request with a 304, keeping only the headers allowed
+// in it
+func writeNotModified(w http.ResponseWriter) {
+	header := w.Header()
+	for _, name := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Transfer-Encoding"} {
+		header.Del(name)
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddETag(t *testing.T) {
+	resp := &web3Response{httpCode: 200, header: http.Header{"Content-Length": {"12"}}, body: io.NopCloser(strings.NewReader("hello, world"))}
+	assert.NoError(t, addETag(resp, 100, false))
+	assert.Equal(t, bodyETag([]byte("hello, world")), resp.header.Get("ETag"))
+	data, err := io.ReadAll(resp.body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, world", string(data))
+
+	// Unknown size: the body is only buffered for the conditional requests
+	unread := &unreadBody{Reader: strings.NewReader("hello, world")}
+	resp = &web3Response{httpCode: 200, header: http.Header{}, body: unread}
+	assert.NoError(t, addETag(resp, 100, false))
+	assert.Equal(t, "", resp.header.Get("ETag"))
+	assert.False(t, unread.read)
+	assert.NoError(t, addETag(resp, 100, true))
+	assert.Equal(t, bodyETag([]byte("hello, world")), resp.header.Get("ETag"))
+
+	// Known to be too large: no ETag, and the body is not read
+	unread = &unreadBody{Reader: strings.NewReader("hello, world")}
+	resp = &web3Response{httpCode: 200, header: http.Header{"Content-Length": {"12"}}, body: unread}
+	assert.NoError(t, addETag(resp, 5, true))
+	assert.Equal(t, "", resp.header.Get("ETag"))
+	assert.False(t, unread.read)
+
+	// Too large: no ETag, but the body is intact
+	resp = &web3Response{httpCode: 200, header: http.Header{}, body: io.NopCloser(strings.NewReader("hello, world"))}
+	assert.NoError(t, addETag(resp, 5, true))
+	assert.Equal(t, "", resp.header.Get("ETag"))
+	data, err = io.ReadAll(resp.body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, world", string(data))
+
+	// The ETag of the contract is kept
+	resp = &web3Response{httpCode: 200, header: http.Header{"Etag": {`"v1"`}}, body: io.NopCloser(strings.NewReader("hello, world"))}
+	assert.NoError(t, addETag(resp, 100, true))
+	assert.Equal(t, `"v1"`, resp.header.Get("ETag"))
+}
+
+// unreadBody is a body which records whether it is read
+type unreadBody struct {
+	io.Reader
+	read bool
+}
+
+func (b *unreadBody) Read(p []byte) (int, error) {
+	b.read = true
+	return b.Reader.Read(p)
+}
+
+func (b *unreadBody) Close() error {
+	return nil
+}
+
+func TestHandleHEADSkipsETag(t *testing.T) {
+	defer func(fetch func(context.Context, string, string) (*web3Response, error)) { fetchUpstream = fetch }(fetchUpstream)
+	var body *unreadBody
+	fetchUpstream = func(ctx context.Context, web3Url string, key string) (*web3Response, error) {
+		body = &unreadBody{Reader: strings.NewReader("hello, world")}
+		return &web3Response{httpCode: http.StatusOK, header: http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"12"}}, body: body}, nil
+	}
+
+	withResolver(&memoryResolver{}, func(now *time.Time) {
+		req := httptest.NewRequest("HEAD", "/0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:11155111/index.txt", nil)
+		rec := httptest.NewRecorder()
+		handle(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "", rec.Header().Get("ETag"))
+		assert.False(t, body.read, "the body of a HEAD request is not read")
+
+		req = httptest.NewRequest("GET", "/0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:11155111/index.txt", nil)
+		rec = httptest.NewRecorder()
+		handle(rec, req)
+		assert.Equal(t, bodyETag([]byte("hello, world")), rec.Header().Get("ETag"))
+		assert.Equal(t, "hello, world", rec.Body.String())
+	})
+}
+
+func TestIsNotModified(t *testing.T) {
+	lastModified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	header := http.Header{}
+	header.Set("ETag", `"abc"`)
+	header.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	tests := []struct {
+		method  string
+		headers map[string]string
+		expect  bool
+	}{
+		{"GET", map[string]string{}, false},
+		{"GET", map[string]string{"If-None-Match": `"abc"`}, true},
+		{"HEAD", map[string]string{"If-None-Match": `"xyz", W/"abc"`}, true},
+		{"GET", map[string]string{"If-None-Match": "*"}, true},
+		{"GET", map[string]string{"If-None-Match": `"xyz"`}, false},
+		{"POST", map[string]string{"If-None-Match": `"abc"`}, false},
+		{"GET", map[string]string{"If-Modified-Since": lastModified.Format(http.TimeFormat)}, true},
+		{"GET", map[string]string{"If-Modified-Since": lastModified.Add(-time.Hour).Format(http.TimeFormat)}, false},
+		// If-None-Match takes precedence
+		{"GET", map[string]string{"If-None-Match": `"xyz"`, "If-Modified-Since": lastModified.Format(http.TimeFormat)}, false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/", nil)
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		assert.Equal(t, test.expect, isNotModified(req, header), "%+v", test)
+	}
+}
+
+func TestPatchedETag(t *testing.T) {
+	assert.Equal(t, `"abc-web3"`, patchedETag(`"abc"`, ""))
+	assert.Equal(t, `W/"abc-web3"`, patchedETag(`W/"abc"`, ""))
+
+	// The pages whose links are rewritten differ with the gateway URL of the links
+	https := patchedETag(`"abc"`, "https://w3link.io")
+	assert.Regexp(t, `^"abc-web3-[0-9a-f]{8}"$`, https)
+	assert.NotEqual(t, https, patchedETag(`"abc"`, "http://w3link.io"))
+	assert.NotEqual(t, https, patchedETag(`"abc"`, "https://w3eth.io"))
+}
+
+func TestResponseCacheETag(t *testing.T) {
+	cache := newResponseCache(ResponseCacheConfig{})
+	capture(t, cache, "a", "hello, world")
+	entry := cache.get("a")
+	assert.NotNil(t, entry)
+	assert.Equal(t, bodyETag([]byte("hello, world")), entry.header.Get("ETag"))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Defaults of the CORS preflight responses
+var (
+	defaultCORSAllowMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	defaultCORSMaxAge       = 86400
+)
+
+// The response headers readable by the browser code by default: the debug headers of the gateway,
+// and the ones of the conditional and range requests
+var defaultCORSExposeHeaders = []string{
+	"ETag", "Content-Range", "Accept-Ranges",
+	"Web3-Host-Domain-Name-Resolver", "Web3-Host-Domain-Name-Resolver-Chain", "Web3-Contract-Address",
+	"Web3-Chain-Id", "Web3-Resolve-Mode", "Web3-Contract-Call-Mode", "Web3-Calldata",
+	"Web3-Mode-Auto-Method", "Web3-Mode-Auto-Method-Arg-Types", "Web3-Mode-Auto-Method-Arg-Values",
+	"Web3-Contract-Return-Processing", "Web3-Decoded-ABI-Encoded-Bytes-Mime-Type", "Web3-Json-Encoded-Value-Types",
+	"Web3-Cache-Status", "Web3-CNAME", "Web3-Custom-Domain-Root", "X-Request-ID",
+}
+
+// corsPolicy decides the CORS headers of the responses, from a comma separated list of origins.
+// Each origin is either "*" (any origin), an exact origin, or an origin with a wildcard subdomain.
+// e.g. "https://ourproject.org, https://*.ourproject.org, http://localhost:3000"
+type corsPolicy struct {
+	anyOrigin        bool
+	origins          []string // exact origins, e.g. https://ourproject.org
+	wildcards        []string // wildcard origins, without "*", e.g. https://.ourproject.org
+	allowCredentials bool
+	exposeHeaders    string
+}
+
+func newCORSPolicy(origins string, allowCredentials bool, exposeHeaders []string) corsPolicy {
+	policy := corsPolicy{allowCredentials: allowCredentials}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		switch {
+		case origin == "":
+		case origin == "*":
+			policy.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			policy.wildcards = append(policy.wildcards, strings.Replace(origin, "://*.", "://.", 1))
+		default:
+			policy.origins = append(policy.origins, origin)
+		}
+	}
+	if exposeHeaders == nil {
+		exposeHeaders = defaultCORSExposeHeaders
+	}
+	policy.exposeHeaders = strings.Join(exposeHeaders, ", ")
+	return policy
+}
+
+// allows tells if an origin may read the responses
+func (p corsPolicy) allows(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.origins {
+		if origin == allowed {
+			return true
+		}
+	}
+	for _, wildcard := range p.wildcards {
+		// https://.ourproject.org matches https://app.ourproject.org, https://a.b.ourproject.org
+		scheme, suffix, _ := strings.Cut(wildcard, "://")
+		if rest, ok := strings.CutPrefix(origin, scheme+"://"); ok && strings.HasSuffix(rest, suffix) && len(rest) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// setHeaders sets the CORS headers of the response to a request. The origin of the request is
+// reflected if it is allowed, except when any origin is allowed without credentials.
+func (p corsPolicy) setHeaders(header http.Header, req *http.Request) {
+	if p.anyOrigin && !p.allowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		// The response depends on the origin
+		header.Add("Vary", "Origin")
+		origin := req.Header.Get("Origin")
+		if origin == "" || !p.allows(origin) {
+			return
+		}
+		header.Set("Access-Control-Allow-Origin", origin)
+		if p.allowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+	if p.exposeHeaders != "" && req.Method != http.MethodOptions {
+		header.Set("Access-Control-Expose-Headers", p.exposeHeaders)
+	}
+}
+
+// gatewayCORS is the CORS policy of the gateway, without custom domain override
+var gatewayCORS corsPolicy
+
+// initCORSPolicy builds the CORS policy of the gateway from the config
+func initCORSPolicy() {
+	gatewayCORS = newCORSPolicy(config.CORS, config.CORSAllowCredentials, config.CORSExposeHeaders)
+}
+
+// The methods served by the gateway
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+// handleOptions answers an OPTIONS request: a CORS preflight if it is one, or else the list of
+// the methods served by the gateway
+func handleOptions(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Origin") == "" || req.Header.Get("Access-Control-Request-Method") == "" {
+		w.Header().Set("Allow", allowedMethods)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	allowMethods := config.CORSAllowMethods
+	if len(allowMethods) == 0 {
+		allowMethods = defaultCORSAllowMethods
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowMethods, ", "))
+	// By default, the headers requested by the browser are allowed
+	if len(config.CORSAllowHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(config.CORSAllowHeaders, ", "))
+	} else if requestHeaders := req.Header.Get("Access-Control-Request-Headers"); requestHeaders != "" {
+		w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+	}
+	maxAge := config.CORSMaxAge
+	if maxAge == 0 {
+		maxAge = defaultCORSMaxAge
+	}
+	if maxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
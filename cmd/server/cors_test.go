@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleOptions(t *testing.T) {
+	defer func(methods, headers []string, maxAge int) {
+		config.CORSAllowMethods, config.CORSAllowHeaders, config.CORSMaxAge = methods, headers, maxAge
+	}(config.CORSAllowMethods, config.CORSAllowHeaders, config.CORSMaxAge)
+	config.CORSAllowMethods, config.CORSAllowHeaders, config.CORSMaxAge = nil, nil, 0
+
+	// Not a preflight
+	req := httptest.NewRequest("OPTIONS", "/index.html", nil)
+	w := httptest.NewRecorder()
+	handleOptions(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS", w.Header().Get("Allow"))
+	assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Methods"))
+
+	// Preflight, with the defaults
+	req.Header.Set("Origin", "https://app.example.org")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "x-requested-with")
+	w = httptest.NewRecorder()
+	handleOptions(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "x-requested-with", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "86400", w.Header().Get("Access-Control-Max-Age"))
+
+	// Preflight, from the config
+	config.CORSAllowMethods = []string{"GET"}
+	config.CORSAllowHeaders = []string{"Range", "If-None-Match"}
+	config.CORSMaxAge = -1
+	w = httptest.NewRecorder()
+	handleOptions(w, req)
+	assert.Equal(t, "GET", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Range, If-None-Match", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "", w.Header().Get("Access-Control-Max-Age"))
+}
+
+func TestCORSPolicy(t *testing.T) {
+	policy := newCORSPolicy("https://ourproject.org/, https://*.OurProject.org,http://localhost:3000", false, []string{"ETag"})
+	tests := []struct {
+		origin string
+		expect bool
+	}{
+		{"https://ourproject.org", true},
+		{"https://OurProject.org", true},
+		{"https://app.ourproject.org", true},
+		{"https://a.b.ourproject.org", true},
+		{"http://app.ourproject.org", false},
+		{"https://evilourproject.org", false},
+		{"https://ourproject.org.evil.com", false},
+		{"http://localhost:3000", true},
+		{"http://localhost:3001", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expect, policy.allows(test.origin), test.origin)
+	}
+
+	// The allowed origins are reflected
+	req := httptest.NewRequest("GET", "/index.html", nil)
+	req.Header.Set("Origin", "https://app.ourproject.org")
+	header := http.Header{}
+	policy.setHeaders(header, req)
+	assert.Equal(t, "https://app.ourproject.org", header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", header.Get("Vary"))
+	assert.Equal(t, "ETag", header.Get("Access-Control-Expose-Headers"))
+	assert.Equal(t, "", header.Get("Access-Control-Allow-Credentials"))
+
+	req.Header.Set("Origin", "https://other.org")
+	header = http.Header{}
+	policy.setHeaders(header, req)
+	assert.Equal(t, "", header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", header.Get("Vary"))
+
+	// Any origin
+	header = http.Header{}
+	newCORSPolicy("*", false, nil).setHeaders(header, req)
+	assert.Equal(t, "*", header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", header.Get("Vary"))
+	assert.Contains(t, header.Get("Access-Control-Expose-Headers"), "Web3-Chain-Id")
+
+	// Any origin, with credentials: "*" is not allowed by browsers
+	header = http.Header{}
+	newCORSPolicy("*", true, nil).setHeaders(header, req)
+	assert.Equal(t, "https://other.org", header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", header.Get("Access-Control-Allow-Credentials"))
+}
+
+func TestSitePolicyCORS(t *testing.T) {
+	defer func(cors string, allowCredentials bool) {
+		config.CORS, config.CORSAllowCredentials = cors, allowCredentials
+		initCORSPolicy()
+	}(config.CORS, config.CORSAllowCredentials)
+	config.CORS, config.CORSAllowCredentials = "https://ourproject.org", true
+	initCORSPolicy()
+
+	allowCredentials := false
+	policy := newSitePolicy(&CustomDomain{Root: "web3://blog.eth:1/", CORSAllowCredentials: &allowCredentials})
+	assert.Equal(t, newCORSPolicy("https://ourproject.org", false, nil), policy.cors)
+	policy = newSitePolicy(&CustomDomain{Root: "web3://blog.eth:1/", CORS: "*"})
+	assert.Equal(t, newCORSPolicy("*", true, nil), policy.cors)
+	assert.Equal(t, newCORSPolicy("https://ourproject.org", true, nil), newSitePolicy(nil).cors)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Custom domains: a domain pointing to the gateway is served from a web3:// root URL, given either
+// in the [customDomains] section of the config, e.g.
+// [customDomains."blog.ourproject.org"]
+// Root = "web3://blog.eth:1/"
+// or in the TXT record of its _web3 subdomain, e.g.
+// _web3.docs.ourproject.org. TXT "web3://docs.ourproject.eth:1/"
+// https://docs.ourproject.org/guide/index.html -> web3://docs.ourproject.eth:1/guide/index.html
+// The record may also be written dnslink-style: "dnslink=web3://docs.ourproject.eth:1/"
+const customDomainTXTPrefix = "_web3."
+
+// dnsResolver is the part of net.Resolver used by the gateway, so that tests can use an
+// in-memory stand-in
+type dnsResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupCNAME(ctx context.Context, host string) (string, error)
+}
+
+var dnsLookup dnsResolver = net.DefaultResolver
+
+// CustomDomain maps a host name to a web3:// root URL, with optional overrides of the gateway
+// settings for this domain
+type CustomDomain struct {
+	Root                 string
+	CORS                 string // comma separated list of origins, see corsPolicy
+	CORSAllowCredentials *bool
+	CORSExposeHeaders    []string
+	HomePage             string
+	PatchHTML            *bool
+	CacheControl         string // Cache-Control header of the responses, replacing the one of the contract
+}
+
+// sitePolicy holds the settings applying to a request: the gateway settings, with the overrides
+// of the custom domain, if any
+type sitePolicy struct {
+	cors         corsPolicy
+	homePage     string
+	patchHTML    bool
+	cacheControl string
+}
+
+func newSitePolicy(site *CustomDomain) sitePolicy {
+	policy := sitePolicy{
+		cors:      gatewayCORS,
+		homePage:  config.HomePage,
+		patchHTML: true,
+	}
+	if site == nil {
+		return policy
+	}
+	if site.CORS != "" || site.CORSAllowCredentials != nil || site.CORSExposeHeaders != nil {
+		origins, allowCredentials, exposeHeaders := config.CORS, config.CORSAllowCredentials, config.CORSExposeHeaders
+		if site.CORS != "" {
+			origins = site.CORS
+		}
+		if site.CORSAllowCredentials != nil {
+			allowCredentials = *site.CORSAllowCredentials
+		}
+		if site.CORSExposeHeaders != nil {
+			exposeHeaders = site.CORSExposeHeaders
+		}
+		policy.cors = newCORSPolicy(origins, allowCredentials, exposeHeaders)
+	}
+	if site.HomePage != "" {
+		policy.homePage = site.HomePage
+	}
+	if site.PatchHTML != nil {
+		policy.patchHTML = *site.PatchHTML
+	}
+	policy.cacheControl = site.CacheControl
+	return policy
+}
+
+// validateCustomDomains normalizes the host names of the configured custom domains, and checks
+// their web3:// root URLs
+func validateCustomDomains() error {
+	customDomains := make(map[string]CustomDomain, len(config.CustomDomains))
+	for host, site := range config.CustomDomains {
+		if _, _, _, err := parseWeb3Url(site.Root); err != nil {
+			return fmt.Errorf("custom domain %v: %v", host, err)
+		}
+		customDomains[strings.ToLower(strings.TrimSuffix(host, "."))] = site
+	}
+	config.CustomDomains = customDomains
+	return nil
+}
+
+// lookupCustomDomain returns the custom domain of a request host, or nil if the host is not a
+// custom domain. The config is consulted first, then the _web3 TXT records if CustomDomainLookup
+// is enabled. If the TXT lookup fails, the custom domain is nil, along with the error: the host
+// is then served as a gateway host.
+func lookupCustomDomain(ctx context.Context, host string) (*CustomDomain, error) {
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		host = host[:i]
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if site, ok := config.CustomDomains[host]; ok {
+		return &site, nil
+	}
+
+	if !config.CustomDomainLookup {
+		return nil, nil
+	}
+	web3Root, err := resolveCustomDomain(ctx, host)
+	if err != nil || web3Root == "" {
+		return nil, err
+	}
+	return &CustomDomain{Root: web3Root}, nil
+}
+
+var (
+	customDomainRoots     *dnsCache
+	customDomainRootsOnce sync.Once
+)
+
+// getCustomDomainRoots returns the cache of the web3:// roots of custom domains, including the
+// domains without record
+func getCustomDomainRoots() *dnsCache {
+	customDomainRootsOnce.Do(func() {
+		ttl := customDomainCacheTTL()
+		customDomainRoots = newDNSCache(ttl, ttl, 10000)
+	})
+	return customDomainRoots
+}
+
+// customDomainCacheTTL returns how long the resolution of a custom domain is kept
+func customDomainCacheTTL() time.Duration {
+	if config.CustomDomainCacheSeconds > 0 {
+		return time.Duration(config.CustomDomainCacheSeconds) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// resolveCustomDomain returns the web3:// root URL of a custom domain, from its _web3 TXT record,
+// or "" if the host is not a custom domain
+func resolveCustomDomain(ctx context.Context, host string) (string, error) {
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		host = host[:i]
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil || !strings.Contains(host, ".") {
+		return "", nil
+	}
+	// The gateway domains and their subdomains are served by the host routes, as well as the hosts
+	// with a contract address or a chain matched by a host route
+	if isGatewayHost(host) || matchesHostRoute(host) {
+		return "", nil
+	}
+
+	web3Root, _, err := getCustomDomainRoots().lookup(ctx, host, func(ctx context.Context) (string, bool, error) {
+		records, err := dnsLookup.LookupTXT(ctx, customDomainTXTPrefix+host)
+		if isDNSNotFound(err) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		for _, record := range records {
+			record = strings.TrimSpace(record)
+			record = strings.TrimPrefix(record, "dnslink=")
+			if !isWeb3Url(record) {
+				continue
+			}
+			if _, _, _, err := parseWeb3Url(record); err != nil {
+				log.Infof("Ignoring invalid web3 URL in TXT record of %v: %v", host, err)
+				continue
+			}
+			return record, true, nil
+		}
+		return "", false, nil
+	})
+	if err != nil {
+		// Failures are cached for a short time, and retried after
+		return "", fmt.Errorf("cannot resolve custom domain %v: %v", host, err)
+	}
+	return web3Root, nil
+}
+
+// isDNSNotFound tells if a DNS lookup failed because the record does not exist
+func isDNSNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// customDomainPath returns the web3:// URL (without "web3:/" prefix and the query) of a request
+// path on a custom domain
+// e.g. web3://docs.ourproject.eth:gor/site/ + /guide/index.html -> /docs.ourproject.eth:5/site/guide/index.html
+func customDomainPath(web3Root string, path string) (string, error) {
+	hostname, chainId, rootPath, err := parseWeb3Url(web3Root)
+	if err != nil {
+		return "", err
+	}
+	// The query of the request replaces the one of the root
+	rootPath = strings.TrimSuffix(strings.SplitN(rootPath, "?", 2)[0], "/")
+	if chainId != "" {
+		hostname += ":" + chainId
+	}
+	return "/" + hostname + rootPath + path, nil
+}
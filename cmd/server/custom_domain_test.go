@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryResolver is an in-memory DNS stand-in
+type memoryResolver struct {
+	txt     map[string][]string
+	cname   map[string]string
+	fail    bool
+	lookups int
+}
+
+func (r *memoryResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.lookups++
+	if r.fail {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if records, ok := r.txt[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *memoryResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	r.lookups++
+	if r.fail {
+		return "", &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	if cname, ok := r.cname[host]; ok {
+		return cname, nil
+	}
+	return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// withResolver runs f with an in-memory resolver, fresh DNS caches and a fake clock
+func withResolver(resolver *memoryResolver, f func(now *time.Time)) {
+	defer func(lookup dnsResolver, roots *dnsCache, cnames *dnsCache) {
+		dnsLookup, customDomainRoots, cnameCache = lookup, roots, cnames
+	}(dnsLookup, getCustomDomainRoots(), getCnameCache())
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	dnsLookup = resolver
+	customDomainRoots = newDNSCache(customDomainCacheTTL(), customDomainCacheTTL(), 10000)
+	customDomainRoots.now = func() time.Time { return now }
+	cnameCache = newDNSCache(time.Minute, 10*time.Second, 3)
+	cnameCache.now = func() time.Time { return now }
+	f(&now)
+}
+
+func TestResolveCustomDomain(t *testing.T) {
+	resolver := &memoryResolver{txt: map[string][]string{
+		"_web3.docs.ourproject.org": {"v=spf1 -all", "web3://docs.ourproject.eth:1/"},
+		"_web3.blog.ourproject.org": {"dnslink=web3://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:sep/blog/"},
+		"_web3.bad.ourproject.org":  {"web3://blog.eth:notachain/"},
+		"_web3.sub.w3link.io":       {"web3://blog.eth/"},
+		"_web3.0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.sep.ourproject.org": {"web3://blog.eth/"},
+		"_web3.0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.ourproject.org":     {"web3://blog.eth/"},
+	}}
+	defer func(gatewayDomains []string) { config.GatewayDomains = gatewayDomains }(config.GatewayDomains)
+	config.GatewayDomains = []string{"w3link.io"}
+
+	withResolver(resolver, func(now *time.Time) {
+		tests := []struct {
+			host     string
+			web3Root string
+		}{
+			{"docs.ourproject.org", "web3://docs.ourproject.eth:1/"},
+			{"Docs.OurProject.org:443", "web3://docs.ourproject.eth:1/"},
+			{"blog.ourproject.org", "web3://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:sep/blog/"},
+			{"bad.ourproject.org", ""},
+			{"none.ourproject.org", ""},
+			{"sub.w3link.io", ""},
+			{"0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.sep.ourproject.org", ""},
+			{"0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.ourproject.org", ""},
+			{"127.0.0.1", ""},
+			{"localhost", ""},
+		}
+		for _, test := range tests {
+			web3Root, err := resolveCustomDomain(context.Background(), test.host)
+			assert.NoError(t, err, test.host)
+			assert.Equal(t, test.web3Root, web3Root, test.host)
+		}
+		// Gateway domains, hosts matched by a host route with an address or a chain, and IPs are
+		// not looked up, the second docs.ourproject.org comes from the cache
+		assert.Equal(t, 4, resolver.lookups)
+
+		// Negative results are cached too, until they expire
+		_, _ = resolveCustomDomain(context.Background(), "none.ourproject.org")
+		assert.Equal(t, 4, resolver.lookups)
+		*now = now.Add(customDomainCacheTTL() + time.Second)
+		_, _ = resolveCustomDomain(context.Background(), "none.ourproject.org")
+		assert.Equal(t, 5, resolver.lookups)
+	})
+}
+
+func TestResolveCustomDomainFailure(t *testing.T) {
+	resolver := &memoryResolver{fail: true}
+	withResolver(resolver, func(now *time.Time) {
+		_, err := resolveCustomDomain(context.Background(), "docs.ourproject.org")
+		assert.Error(t, err)
+
+		// Failures are cached for a short time
+		resolver.fail = false
+		resolver.txt = map[string][]string{"_web3.docs.ourproject.org": {"web3://docs.ourproject.eth/"}}
+		_, err = resolveCustomDomain(context.Background(), "docs.ourproject.org")
+		assert.Error(t, err)
+		*now = now.Add(getCustomDomainRoots().errorTTL + time.Second)
+		web3Root, err := resolveCustomDomain(context.Background(), "docs.ourproject.org")
+		assert.NoError(t, err)
+		assert.Equal(t, "web3://docs.ourproject.eth/", web3Root)
+
+		// The host of a failed lookup is served as a gateway host, instead of failing
+		defer func(lookup bool, defaultChain int) {
+			config.CustomDomainLookup, config.DefaultChain = lookup, defaultChain
+		}(config.CustomDomainLookup, config.DefaultChain)
+		config.CustomDomainLookup, config.DefaultChain = true, 0
+		resolver.fail = true
+		site, err := lookupCustomDomain(context.Background(), "other.ourproject.org")
+		assert.Error(t, err)
+		assert.Nil(t, site)
+		req := httptest.NewRequest("GET", "/index.html", nil)
+		req.Host = "other.ourproject.org"
+		rec := httptest.NewRecorder()
+		handle(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, "no host route matches other.ourproject.org without default chain")
+	})
+}
+
+func TestCustomDomainPath(t *testing.T) {
+	tests := []struct {
+		web3Root string
+		path     string
+		expect   string
+	}{
+		{"web3://docs.ourproject.eth:1/", "/guide/index.html", "/docs.ourproject.eth:1/guide/index.html"},
+		{"web3://docs.ourproject.eth", "/", "/docs.ourproject.eth/"},
+		{"web3://docs.ourproject.eth:gor/site/", "/guide/", "/docs.ourproject.eth:5/site/guide/"},
+		{"w3://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:sep/site?x=1", "/a.txt", "/0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:11155111/site/a.txt"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v%v", test.web3Root, test.path), func(t *testing.T) {
+			p, err := customDomainPath(test.web3Root, test.path)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expect, p)
+		})
+	}
+}
+
+func TestLookupCustomDomain(t *testing.T) {
+	patchHTML := false
+	defer func(customDomains map[string]CustomDomain, lookup bool) {
+		config.CustomDomains, config.CustomDomainLookup = customDomains, lookup
+	}(config.CustomDomains, config.CustomDomainLookup)
+	config.CustomDomains = map[string]CustomDomain{
+		"Blog.OurProject.org": {Root: "web3://blog.eth:1/", CORS: "https://ourproject.org", HomePage: "/index.html", PatchHTML: &patchHTML, CacheControl: "public, max-age=600"},
+	}
+	config.CustomDomainLookup = true
+	assert.NoError(t, validateCustomDomains())
+
+	resolver := &memoryResolver{txt: map[string][]string{
+		"_web3.blog.ourproject.org": {"web3://other.eth/"},
+		"_web3.docs.ourproject.org": {"web3://docs.ourproject.eth/"},
+	}}
+	withResolver(resolver, func(now *time.Time) {
+		// The config takes precedence over DNS
+		site, err := lookupCustomDomain(context.Background(), "blog.ourproject.org:443")
+		assert.NoError(t, err)
+		assert.Equal(t, "web3://blog.eth:1/", site.Root)
+		assert.Equal(t, sitePolicy{cors: newCORSPolicy("https://ourproject.org", false, nil), homePage: "/index.html", patchHTML: false, cacheControl: "public, max-age=600"}, newSitePolicy(site))
+		assert.Equal(t, 0, resolver.lookups)
+
+		site, err = lookupCustomDomain(context.Background(), "docs.ourproject.org")
+		assert.NoError(t, err)
+		assert.Equal(t, "web3://docs.ourproject.eth/", site.Root)
+		assert.Equal(t, sitePolicy{cors: gatewayCORS, homePage: config.HomePage, patchHTML: true}, newSitePolicy(site))
+
+		site, err = lookupCustomDomain(context.Background(), "none.ourproject.org")
+		assert.NoError(t, err)
+		assert.Nil(t, site)
+
+		// Home page redirection, with the CORS setting of the custom domain
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "blog.ourproject.org"
+		req.Header.Set("Origin", "https://ourproject.org")
+		rec := httptest.NewRecorder()
+		handle(rec, req)
+		assert.Equal(t, http.StatusFound, rec.Code)
+		assert.Equal(t, "/index.html", rec.Header().Get("Location"))
+		assert.Equal(t, "https://ourproject.org", rec.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	config.CustomDomains = map[string]CustomDomain{"bad.ourproject.org": {Root: "https://bad.ourproject.org/"}}
+	assert.Error(t, validateCustomDomains())
+}
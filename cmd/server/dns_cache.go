@@ -0,0 +1,315 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Values of the CNAMELookup setting
+const (
+	cnameLookupAll        = "all"         // default: look up the CNAME of every request host
+	cnameLookupOff        = "off"         // never look up CNAMEs
+	cnameLookupNonGateway = "non-gateway" // only look up the hosts which are not under GatewayDomains
+)
+
+// Defaults of the DNS caches
+const (
+	defaultDNSLookupTimeout = 5 * time.Second
+	dnsErrorTTL             = 5 * time.Second
+	dnsMaxStale             = time.Hour
+)
+
+// dnsCache is a size-bounded LRU cache of DNS lookups. Found values are kept for ttl, missing
+// ones for negativeTTL, and failed lookups for errorTTL. When the refresh of an expired value
+// fails, the expired value is served for up to maxStale more. Concurrent lookups of the same key
+// are collapsed into one, which is bounded by timeout.
+type dnsCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	errorTTL    time.Duration
+	maxStale    time.Duration
+	timeout     time.Duration
+	maxEntries  int
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *dnsCacheEntry, most recently used first
+	calls   map[string]*dnsCacheCall
+
+	stats             dnsCacheStats
+	lookups           int
+	lookupDuration    time.Duration
+	maxLookupDuration time.Duration
+}
+
+type dnsCacheEntry struct {
+	key        string
+	value      string
+	found      bool
+	err        error
+	expires    time.Time
+	staleUntil time.Time // until when the value may be served if its refresh fails
+}
+
+// dnsCacheCall is a lookup in progress, waited for by the concurrent lookups of the same key
+type dnsCacheCall struct {
+	done  chan struct{}
+	value string
+	found bool
+	err   error
+}
+
+// dnsCacheStats are the metrics of a dnsCache
+type dnsCacheStats struct {
+	Hits             uint64  `json:"hits"`
+	NegativeHits     uint64  `json:"negativeHits"`
+	Misses           uint64  `json:"misses"`
+	Collapsed        uint64  `json:"collapsed"`
+	Errors           uint64  `json:"errors"`
+	Stale            uint64  `json:"stale"`
+	Evictions        uint64  `json:"evictions"`
+	Entries          int     `json:"entries"`
+	HitRate          float64 `json:"hitRate"`
+	AvgLookupSeconds float64 `json:"avgLookupSeconds"`
+	MaxLookupSeconds float64 `json:"maxLookupSeconds"`
+}
+
+func newDNSCache(ttl time.Duration, negativeTTL time.Duration, maxEntries int) *dnsCache {
+	return &dnsCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		errorTTL:    dnsErrorTTL,
+		maxStale:    dnsMaxStale,
+		timeout:     secondsOr(config.DNSLookupTimeoutSeconds, defaultDNSLookupTimeout),
+		maxEntries:  maxEntries,
+		now:         time.Now,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		calls:       make(map[string]*dnsCacheCall),
+	}
+}
+
+// lookup returns the cached value of key, or calls fn to look it up. found is false when the
+// record does not exist. fn is called with its own timeout rather than ctx, as the concurrent
+// lookups of the key wait for it: ctx only bounds how long this lookup waits for the result.
+func (c *dnsCache) lookup(ctx context.Context, key string, fn func(ctx context.Context) (value string, found bool, err error)) (value string, found bool, err error) {
+	c.mu.Lock()
+	var stale *dnsCacheEntry
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*dnsCacheEntry)
+		now := c.now()
+		if !now.After(entry.expires) {
+			c.lru.MoveToFront(element)
+			switch {
+			case entry.err != nil:
+				c.stats.Errors++
+			case entry.found:
+				c.stats.Hits++
+			default:
+				c.stats.NegativeHits++
+			}
+			c.mu.Unlock()
+			return entry.value, entry.found, entry.err
+		}
+		if entry.err == nil && !now.After(entry.staleUntil) {
+			// Kept until it is refreshed, in case the refresh fails
+			stale = entry
+		} else {
+			c.removeElement(element)
+		}
+	}
+	call, ok := c.calls[key]
+	if ok {
+		c.stats.Collapsed++
+	} else {
+		call = &dnsCacheCall{done: make(chan struct{})}
+		c.calls[key] = call
+		c.stats.Misses++
+		go c.refresh(key, call, stale, fn)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.found, call.err
+	case <-ctx.Done():
+		return "", false, ctx.Err()
+	}
+}
+
+// refresh looks up a key with fn, and stores the result. If the lookup fails, the stale entry
+// (if any) is served instead, and the lookup is retried after errorTTL.
+func (c *dnsCache) refresh(key string, call *dnsCacheCall, stale *dnsCacheEntry, fn func(ctx context.Context) (value string, found bool, err error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	start := time.Now()
+	call.value, call.found, call.err = fn(ctx)
+	duration := time.Since(start)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.lookups++
+	c.lookupDuration += duration
+	if duration > c.maxLookupDuration {
+		c.maxLookupDuration = duration
+	}
+	now := c.now()
+	switch {
+	case call.err == nil:
+		ttl := c.ttl
+		if !call.found {
+			ttl = c.negativeTTL
+		}
+		c.add(&dnsCacheEntry{key: key, value: call.value, found: call.found, expires: now.Add(ttl), staleUntil: now.Add(ttl + c.maxStale)}, ttl)
+	case stale != nil:
+		log.Infof("Cannot refresh the DNS lookup of %v, serving the expired value: %v", key, call.err)
+		c.stats.Errors++
+		c.stats.Stale++
+		call.value, call.found, call.err = stale.value, stale.found, nil
+		c.add(&dnsCacheEntry{key: key, value: stale.value, found: stale.found, expires: now.Add(c.errorTTL), staleUntil: stale.staleUntil}, c.errorTTL)
+	default:
+		c.stats.Errors++
+		c.add(&dnsCacheEntry{key: key, err: call.err, expires: now.Add(c.errorTTL)}, c.errorTTL)
+	}
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// add stores an entry kept for ttl, evicting the least recently used entries beyond maxEntries
+func (c *dnsCache) add(entry *dnsCacheEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		if element, ok := c.entries[entry.key]; ok {
+			c.removeElement(element)
+		}
+		return
+	}
+	if element, ok := c.entries[entry.key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *dnsCache) removeElement(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*dnsCacheEntry).key)
+}
+
+// getStats returns a snapshot of the metrics of the cache
+func (c *dnsCache) getStats() dnsCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	if total := stats.Hits + stats.NegativeHits + stats.Misses + stats.Collapsed; total > 0 {
+		stats.HitRate = float64(stats.Hits+stats.NegativeHits) / float64(total)
+	}
+	if c.lookups > 0 {
+		stats.AvgLookupSeconds = c.lookupDuration.Seconds() / float64(c.lookups)
+	}
+	stats.MaxLookupSeconds = c.maxLookupDuration.Seconds()
+	return stats
+}
+
+// secondsOr returns a duration of seconds, or defaultDuration if seconds is not set
+func secondsOr(seconds int, defaultDuration time.Duration) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultDuration
+}
+
+var (
+	cnameCache     *dnsCache
+	cnameCacheOnce sync.Once
+)
+
+// getCnameCache returns the CNAME cache, configured from the config
+func getCnameCache() *dnsCache {
+	cnameCacheOnce.Do(func() {
+		maxEntries := config.CNAMECacheSize
+		if maxEntries <= 0 {
+			maxEntries = 10000
+		}
+		cnameCache = newDNSCache(secondsOr(config.CNAMECacheSeconds, 5*time.Minute), secondsOr(config.CNAMENegativeCacheSeconds, time.Minute), maxEntries)
+	})
+	return cnameCache
+}
+
+// validateCnameLookup checks the CNAMELookup setting
+func validateCnameLookup() error {
+	switch config.CNAMELookup {
+	case "", cnameLookupAll, cnameLookupOff, cnameLookupNonGateway:
+		return nil
+	}
+	return fmt.Errorf("unknown CNAMELookup %v, expected %v, %v or %v", config.CNAMELookup, cnameLookupAll, cnameLookupOff, cnameLookupNonGateway)
+}
+
+// lookupCname returns the canonical name of a request host (without port), or "" if it should not
+// or cannot be looked up
+func lookupCname(ctx context.Context, host string) string {
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		host = host[:i]
+	}
+	host = strings.ToLower(host)
+	switch config.CNAMELookup {
+	case cnameLookupOff:
+		return ""
+	case cnameLookupNonGateway:
+		if isGatewayHost(host) {
+			return ""
+		}
+	}
+
+	cname, found, err := getCnameCache().lookup(ctx, host, func(ctx context.Context) (string, bool, error) {
+		cname, err := dnsLookup.LookupCNAME(ctx, host)
+		if isDNSNotFound(err) {
+			return "", false, nil
+		}
+		return cname, err == nil, err
+	})
+	if err != nil {
+		log.Infof("Cannot look up the CNAME of %v: %v", host, err)
+		return ""
+	}
+	if !found {
+		return ""
+	}
+	return cname
+}
+
+// cnameHost returns the host to serve for a request host whose CNAME is target, without its final
+// dot: the request host itself if its CNAME is its own name, or else the target with the port of
+// the request host
+func cnameHost(host string, target string) string {
+	name, port := host, ""
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		name, port = host[:i], host[i:]
+	}
+	if strings.EqualFold(name, target) {
+		return host
+	}
+	return target + port
+}
+
+// handleCnameCacheStats serves the metrics of the CNAME cache
+func handleCnameCacheStats(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(getCnameCache().getStats()); err != nil {
+		log.Errorf("Cannot write CNAME cache stats: %v\n", err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSCache(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := newDNSCache(time.Minute, 10*time.Second, 2)
+	cache.now = func() time.Time { return now }
+
+	lookups := 0
+	lookup := func(key string) (string, bool, error) {
+		return cache.lookup(context.Background(), key, func(ctx context.Context) (string, bool, error) {
+			lookups++
+			switch key {
+			case "missing":
+				return "", false, nil
+			case "failing":
+				return "", false, fmt.Errorf("timeout")
+			}
+			return key + ".target.", true, nil
+		})
+	}
+
+	value, found, err := lookup("a")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "a.target.", value)
+	_, _, _ = lookup("a")
+	assert.Equal(t, 1, lookups)
+
+	// Negative caching, with its own TTL
+	_, found, err = lookup("missing")
+	assert.NoError(t, err)
+	assert.False(t, found)
+	_, _, _ = lookup("missing")
+	assert.Equal(t, 2, lookups)
+	now = now.Add(11 * time.Second)
+	_, _, _ = lookup("missing")
+	assert.Equal(t, 3, lookups)
+
+	// Failures are cached for a short time
+	_, _, err = lookup("failing")
+	assert.Error(t, err)
+	_, _, err = lookup("failing")
+	assert.Error(t, err)
+	assert.Equal(t, 4, lookups)
+
+	// Size bound: "a" is the least recently used entry, and is evicted
+	_, _, _ = lookup("b")
+	assert.Equal(t, 5, lookups)
+	_, _, _ = lookup("a")
+	assert.Equal(t, 6, lookups)
+
+	// Expiration
+	_, _, _ = lookup("a")
+	assert.Equal(t, 6, lookups)
+	now = now.Add(time.Minute + time.Second)
+	_, _, _ = lookup("a")
+	assert.Equal(t, 7, lookups)
+
+	stats := cache.getStats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(1), stats.NegativeHits)
+	assert.Equal(t, uint64(7), stats.Misses)
+	assert.Equal(t, uint64(2), stats.Errors)
+	assert.Equal(t, 2, stats.Entries)
+	assert.InDelta(t, 0.3, stats.HitRate, 1e-9)
+}
+
+func TestDNSCacheServesStale(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := newDNSCache(time.Minute, time.Minute, 10)
+	cache.now = func() time.Time { return now }
+	cache.timeout = 10 * time.Millisecond
+
+	fail := false
+	lookups := 0
+	lookup := func() (string, bool, error) {
+		return cache.lookup(context.Background(), "host", func(ctx context.Context) (string, bool, error) {
+			lookups++
+			if fail {
+				// Never answers: the lookup times out
+				<-ctx.Done()
+				return "", false, ctx.Err()
+			}
+			return "target.", true, nil
+		})
+	}
+
+	value, _, err := lookup()
+	assert.NoError(t, err)
+	assert.Equal(t, "target.", value)
+
+	// The expired value is served when its refresh fails, and the refresh is retried after errorTTL
+	fail = true
+	now = now.Add(2 * time.Minute)
+	value, found, err := lookup()
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "target.", value)
+	value, _, _ = lookup()
+	assert.Equal(t, "target.", value)
+	assert.Equal(t, 2, lookups)
+	now = now.Add(cache.errorTTL + time.Second)
+	value, _, _ = lookup()
+	assert.Equal(t, "target.", value)
+	assert.Equal(t, 3, lookups)
+
+	// But not beyond maxStale
+	now = now.Add(cache.maxStale)
+	_, _, err = lookup()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 4, lookups)
+
+	stats := cache.getStats()
+	assert.Equal(t, uint64(2), stats.Stale)
+	assert.Equal(t, uint64(3), stats.Errors)
+
+	// A lookup waits no longer than its context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	now = now.Add(time.Hour)
+	_, _, err = cache.lookup(ctx, "other", func(ctx context.Context) (string, bool, error) {
+		<-ctx.Done()
+		return "", false, ctx.Err()
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDNSCacheCollapsesLookups(t *testing.T) {
+	cache := newDNSCache(time.Minute, time.Minute, 10)
+	release := make(chan struct{})
+	lookups := 0
+
+	var wg sync.WaitGroup
+	results := make([]string, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, _ = cache.lookup(context.Background(), "host", func(ctx context.Context) (string, bool, error) {
+				lookups++
+				<-release
+				return "target.", true, nil
+			})
+		}(i)
+	}
+	// Let the lookups pile up on the first one
+	for {
+		cache.mu.Lock()
+		waiting := cache.stats.Misses + cache.stats.Collapsed
+		cache.mu.Unlock()
+		if waiting == uint64(len(results)) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, 1, lookups)
+	for _, result := range results {
+		assert.Equal(t, "target.", result)
+	}
+}
+
+func TestLookupCname(t *testing.T) {
+	resolver := &memoryResolver{cname: map[string]string{
+		"blog.ourproject.org":       "quark.w3q.w3q-g.w3link.io.",
+		"quark.w3q.w3q-g.w3link.io": "quark.w3q.w3q-g.w3link.io.",
+	}}
+	defer func(cnameLookup string, gatewayDomains []string) {
+		config.CNAMELookup, config.GatewayDomains = cnameLookup, gatewayDomains
+	}(config.CNAMELookup, config.GatewayDomains)
+	config.GatewayDomains = []string{"w3link.io"}
+
+	withResolver(resolver, func(now *time.Time) {
+		config.CNAMELookup = cnameLookupAll
+		assert.Equal(t, "quark.w3q.w3q-g.w3link.io.", lookupCname(context.Background(), "blog.ourproject.org:443"))
+		assert.Equal(t, "quark.w3q.w3q-g.w3link.io.", lookupCname(context.Background(), "quark.w3q.w3q-g.w3link.io"))
+		assert.Equal(t, "", lookupCname(context.Background(), "none.ourproject.org"))
+		assert.Equal(t, 3, resolver.lookups)
+
+		// Gateway hosts are not looked up, and the others come from the cache
+		config.CNAMELookup = cnameLookupNonGateway
+		assert.Equal(t, "", lookupCname(context.Background(), "quark.w3q.w3q-g.w3link.io"))
+		assert.Equal(t, "quark.w3q.w3q-g.w3link.io.", lookupCname(context.Background(), "blog.ourproject.org"))
+		assert.Equal(t, 3, resolver.lookups)
+
+		config.CNAMELookup = cnameLookupOff
+		assert.Equal(t, "", lookupCname(context.Background(), "other.ourproject.org"))
+		assert.Equal(t, 3, resolver.lookups)
+
+		// DNS failures are not fatal
+		config.CNAMELookup = cnameLookupAll
+		resolver.fail = true
+		assert.Equal(t, "", lookupCname(context.Background(), "other.ourproject.org"))
+	})
+
+	config.CNAMELookup = "sometimes"
+	assert.Error(t, validateCnameLookup())
+}
+
+func TestCnameHost(t *testing.T) {
+	assert.Equal(t, "quark.w3q.w3q-g.w3link.io", cnameHost("blog.ourproject.org", "quark.w3q.w3q-g.w3link.io"))
+	assert.Equal(t, "quark.w3q.w3q-g.w3link.io:8080", cnameHost("blog.ourproject.org:8080", "quark.w3q.w3q-g.w3link.io"))
+	// The host is kept as is when its CNAME is its own name
+	assert.Equal(t, "Quark.w3q.w3q-g.w3link.io:8080", cnameHost("Quark.w3q.w3q-g.w3link.io:8080", "quark.w3q.w3q-g.w3link.io"))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/web3-protocol/web3protocol-go"
+)
+
+// web3Response is the response of a web3:// URL, before the processing done by the gateway for
+// each request
+type web3Response struct {
+	httpCode    int
+	header      http.Header // the headers returned by the contract, and the Web3-* debug headers
+	body        io.ReadCloser
+	chainId     int
+	nsType      string
+	cacheStatus string // "" if the response cache is disabled
+}
+
+// fetchUpstream fetches a web3:// URL from the chain, so that tests can use an in-memory stand-in
+var fetchUpstream = fetchWeb3ResponseUpstream
+
+// fetchWeb3Response returns the response of a web3:// URL, from the response cache if possible
+func fetchWeb3Response(web3Url string, req *http.Request) (*web3Response, error) {
+	cacheStatus, key := "", ""
+	if responses != nil {
+		key = responses.key(web3Url, req)
+		cacheStatus = cacheStatusMiss
+		if isNoCacheRequest(req) {
+			cacheStatus = cacheStatusBypass
+			responses.bypass()
+		} else if entry := responses.get(key); entry != nil {
+			// The body file may have been evicted in between
+			if body, err := entry.open(); err == nil {
+				return &web3Response{
+					httpCode:    entry.httpCode,
+					header:      entry.header.Clone(),
+					body:        body,
+					chainId:     entry.chainId,
+					nsType:      entry.nsType,
+					cacheStatus: cacheStatusHit,
+				}, nil
+			}
+		}
+	}
+
+	// Fetch the web3 URL, sharing the fetch with the identical concurrent requests, until the
+	// deadline of the request
+	resp, err := fetchUntilDone(req.Context(), func() (*web3Response, error) {
+		if config.CoalesceFetches {
+			return inflightFetches.do(req.Context(), coalesceKey(web3Url), func() (*web3Response, error) {
+				// The shared fetch is not given up with the request which started it, but at its
+				// own deadline: each request stops waiting for it at the deadline of its own
+				ctx, cancel := context.WithTimeout(valuesContext{context.Background(), req.Context()}, requestTimeout())
+				defer cancel()
+				return fetchUpstream(ctx, web3Url, key)
+			})
+		}
+		return fetchUpstream(req.Context(), web3Url, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.cacheStatus = cacheStatus
+	return resp, nil
+}
+
+// fetchWeb3ResponseUpstream fetches a web3:// URL, and stores its response under the cache key
+// while its body is read. Its RPC calls, including those of the body, are made for ctx.
+func fetchWeb3ResponseUpstream(ctx context.Context, web3Url string, key string) (*web3Response, error) {
+	slot, err := fetchSlots.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fetchedWeb3Url, err := slot.client.FetchUrl(web3Url)
+	if err != nil {
+		slot.release()
+		if throttled := asRPCThrottled(err); throttled != nil {
+			return nil, throttled
+		}
+		return nil, err
+	}
+	header, err := web3ResponseHeader(&fetchedWeb3Url)
+	if err != nil {
+		slot.release()
+		return nil, err
+	}
+	parsedWeb3Url := fetchedWeb3Url.ParsedUrl
+	resp := &web3Response{
+		httpCode: fetchedWeb3Url.HttpCode,
+		header:   header,
+		body:     slot.body(fetchedWeb3Url.Output, ctx),
+		chainId:  parsedWeb3Url.ChainId,
+		nsType:   fmt.Sprintf("%v", parsedWeb3Url.HostDomainNameResolver),
+	}
+
+	// Store the response in the cache while the body is streamed
+	if responses != nil {
+		if ttl := responses.ttl(resp.httpCode, resp.header, resp.chainId); ttl > 0 {
+			now := responses.now()
+			resp.body = &responseCapture{
+				cache: responses,
+				r:     resp.body,
+				entry: &cachedResponse{
+					key:      key,
+					httpCode: resp.httpCode,
+					header:   resp.header.Clone(),
+					chainId:  resp.chainId,
+					nsType:   resp.nsType,
+					stored:   now,
+					expires:  now.Add(ttl),
+				},
+			}
+		}
+	}
+	return resp, nil
+}
+
+// isNoCacheRequest tells if a request asks not to be served from cache
+func isNoCacheRequest(req *http.Request) bool {
+	return strings.Contains(strings.ToLower(req.Header.Get("Cache-Control")), "no-cache") ||
+		strings.Contains(strings.ToLower(req.Header.Get("Pragma")), "no-cache")
+}
+
+// web3ResponseHeader returns the HTTP headers returned by the protocol, with some debug headers
+func web3ResponseHeader(fetchedWeb3Url *web3protocol.FetchedWeb3URL) (http.Header, error) {
+	header := http.Header{}
+
+	// The HTTP headers returned by the protocol
+	for httpHeaderName, httpHeaderValue := range fetchedWeb3Url.HttpHeaders {
+		header.Set(httpHeaderName, httpHeaderValue)
+	}
+
+	// Add some debug headers
+	parsedWeb3Url := fetchedWeb3Url.ParsedUrl
+	if parsedWeb3Url.HostDomainNameResolver != "" {
+		header.Set("Web3-Host-Domain-Name-Resolver", string(parsedWeb3Url.HostDomainNameResolver))
+		header.Set("Web3-Host-Domain-Name-Resolver-Chain", fmt.Sprintf("%d", parsedWeb3Url.HostDomainNameResolverChainId))
+	}
+	header.Set("Web3-Contract-Address", parsedWeb3Url.ContractAddress.String())
+	header.Set("Web3-Chain-Id", fmt.Sprintf("%d", parsedWeb3Url.ChainId))
+	header.Set("Web3-Resolve-Mode", string(parsedWeb3Url.ResolveMode))
+	header.Set("Web3-Contract-Call-Mode", string(parsedWeb3Url.ContractCallMode))
+	calldata, _ := parsedWeb3Url.ComputeCalldata()
+	header.Set("Web3-Calldata", fmt.Sprintf("0x%x", calldata))
+	if parsedWeb3Url.ContractCallMode == web3protocol.ContractCallModeMethod {
+		header.Set("Web3-Mode-Auto-Method", parsedWeb3Url.MethodName)
+		methodArgTypes := []string{}
+		for _, methodArgType := range parsedWeb3Url.MethodArgs {
+			methodArgTypes = append(methodArgTypes, methodArgType.String())
+		}
+		header.Set("Web3-Mode-Auto-Method-Arg-Types", strings.Join(methodArgTypes, ","))
+		formattedMethodArgValues := make([]interface{}, 0)
+		for i, methodArgValue := range parsedWeb3Url.MethodArgValues {
+			formattedValue, err := web3protocol.JsonEncodeAbiTypeValue(parsedWeb3Url.MethodArgs[i], methodArgValue)
+			if err != nil {
+				return nil, err
+			}
+			formattedMethodArgValues = append(formattedMethodArgValues, formattedValue)
+		}
+		jsonEncodedMethodArgValues, err := json.Marshal(formattedMethodArgValues)
+		if err != nil {
+			return nil, err
+		}
+		header.Set("Web3-Mode-Auto-Method-Arg-Values", string(jsonEncodedMethodArgValues))
+	}
+	header.Set("Web3-Contract-Return-Processing", string(parsedWeb3Url.ContractReturnProcessing))
+	if parsedWeb3Url.ContractReturnProcessing == web3protocol.ContractReturnProcessingDecodeABIEncodedBytes {
+		header.Set("Web3-Decoded-ABI-Encoded-Bytes-Mime-Type", parsedWeb3Url.DecodedABIEncodedBytesMimeType)
+	} else if parsedWeb3Url.ContractReturnProcessing == web3protocol.ContractReturnProcessingJsonEncodeValues {
+		valueTypes := []string{}
+		for _, valueType := range parsedWeb3Url.JsonEncodedValueTypes {
+			valueTypes = append(valueTypes, valueType.String())
+		}
+		header.Set("Web3-Json-Encoded-Value-Types", strings.Join(valueTypes, ","))
+	}
+	return header, nil
+}
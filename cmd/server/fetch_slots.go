@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/web3-protocol/web3protocol-go"
+)
+
+// web3protocol-go does not pass the context of a fetch on to its RPC calls. So each fetch uses a
+// web3:// client of its own, a slot, whose RPC calls go through its own path of the RPC proxy
+// (e.g. /chain/1/3 for the slot 3): the proxy finds the context of the fetch of each call from its
+// path. The proxy refuses the calls of the fetches past their deadline, so that the fetches given
+// up by fetchUntilDone do not go on in the background. The slots are reused by the later fetches:
+// there are at most MaxConcurrentFetches, and those left free for a while are dropped.
+
+// Defaults of the fetch slots
+const (
+	defaultMaxConcurrentFetches = 256
+	fetchSlotIdleTimeout        = time.Minute
+)
+
+// fetchSlot is a web3:// client, and the context of the fetch using it
+type fetchSlot struct {
+	id       int
+	client   *web3protocol.Client
+	pool     *fetchSlotPool
+	released time.Time // when the slot was last freed
+
+	mu     sync.Mutex
+	ctx    context.Context // nil while the slot is free
+	leases uint64          // the times the slot was acquired, the current lease of the slot
+}
+
+// fetchSlotPool holds the slots of the fetches. The fetches over its size wait for a free slot.
+type fetchSlotPool struct {
+	inUse chan struct{} // a token per slot in use
+	now   func() time.Time
+
+	mu     sync.Mutex
+	slots  map[int]*fetchSlot
+	free   []*fetchSlot // the least recently freed first
+	nextId int
+}
+
+func newFetchSlotPool(size int) *fetchSlotPool {
+	if size <= 0 {
+		size = defaultMaxConcurrentFetches
+	}
+	return &fetchSlotPool{inUse: make(chan struct{}, size), now: time.Now, slots: map[int]*fetchSlot{}}
+}
+
+var fetchSlots = newFetchSlotPool(defaultMaxConcurrentFetches)
+
+// acquire returns a free slot, bound to the context of a fetch. It waits for one while the pool
+// is full, until ctx is done.
+func (p *fetchSlotPool) acquire(ctx context.Context) (*fetchSlot, error) {
+	select {
+	case p.inUse <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	p.mu.Lock()
+	p.dropIdle()
+	var slot *fetchSlot
+	if n := len(p.free); n > 0 {
+		slot = p.free[n-1]
+		p.free = p.free[:n-1]
+	} else {
+		p.nextId++
+		slot = &fetchSlot{id: p.nextId, client: newSlotClient(p.nextId), pool: p}
+		p.slots[slot.id] = slot
+	}
+	p.mu.Unlock()
+	slot.mu.Lock()
+	slot.leases++
+	slot.ctx = ctx
+	slot.mu.Unlock()
+	return slot, nil
+}
+
+// dropIdle drops the slots free for longer than fetchSlotIdleTimeout, with their client
+func (p *fetchSlotPool) dropIdle() {
+	idle := 0
+	for idle < len(p.free) && p.now().Sub(p.free[idle].released) > fetchSlotIdleTimeout {
+		delete(p.slots, p.free[idle].id)
+		idle++
+	}
+	p.free = append(p.free[:0], p.free[idle:]...)
+}
+
+func (p *fetchSlotPool) slot(id int) *fetchSlot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.slots[id]
+}
+
+// newSlotClient returns a client like web3protocolClient, whose RPC calls go through the path of
+// a slot. It shares the name service settings and the name resolution cache of web3protocolClient.
+func newSlotClient(id int) *web3protocol.Client {
+	slotConfig := *web3protocolClient.Config
+	slotConfig.Chains = map[int]web3protocol.ChainConfig{}
+	for chainId, chainConfig := range web3protocolClient.Config.Chains {
+		chainConfig.RPC += "/" + strconv.Itoa(id)
+		slotConfig.Chains[chainId] = chainConfig
+	}
+	client := web3protocol.NewClient(&slotConfig)
+	client.DomainNameResolutionCache = web3protocolClient.DomainNameResolutionCache
+	return client
+}
+
+func (s *fetchSlot) bind(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+}
+
+// rebind binds the slot to the context of the current read of a body, unless the body is closed
+// and the slot freed, maybe acquired again by another fetch
+func (s *fetchSlot) rebind(lease uint64, ctx context.Context) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil || s.leases != lease {
+		return false
+	}
+	s.ctx = ctx
+	return true
+}
+
+func (s *fetchSlot) context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ctx
+}
+
+// release frees the slot for the next fetches
+func (s *fetchSlot) release() {
+	s.bind(nil)
+	p := s.pool
+	p.mu.Lock()
+	s.released = p.now()
+	p.free = append(p.free, s)
+	p.dropIdle()
+	p.mu.Unlock()
+	<-p.inUse
+}
+
+// body returns the body of the fetch using the slot, read from r
+func (s *fetchSlot) body(r io.Reader, values context.Context) *slotBody {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &slotBody{Reader: r, slot: s, lease: s.leases, values: values}
+}
+
+// fetchSlotContext returns the context of the fetch a request of the RPC proxy is made for, or
+// nil if it is unknown
+func fetchSlotContext(req *http.Request) context.Context {
+	_, slotPath, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/chain/"), "/")
+	if !ok {
+		return nil
+	}
+	id, err := strconv.Atoi(slotPath)
+	if err != nil {
+		return nil
+	}
+	slot := fetchSlots.slot(id)
+	if slot == nil {
+		return nil
+	}
+	return slot.context()
+}
+
+// slotBody is the body of a fetch, whose chunks are fetched by the client of its slot. Each read
+// must complete within the request timeout. The slot is released once the body is closed.
+type slotBody struct {
+	io.Reader
+	slot   *fetchSlot
+	lease  uint64          // the lease of the slot by the fetch
+	values context.Context // the context of the fetch, for the trace and the info of its request
+	once   sync.Once
+}
+
+func (b *slotBody) Read(p []byte) (int, error) {
+	// The body is streamed past the deadline of the fetch, see WriteTimeoutSeconds
+	ctx, cancel := context.WithTimeout(valuesContext{context.Background(), b.values}, requestTimeout())
+	defer cancel()
+	if !b.slot.rebind(b.lease, ctx) {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := b.Reader.Read(p)
+	if err != nil && err != io.EOF && ctx.Err() != nil {
+		return n, ctx.Err()
+	}
+	return n, err
+}
+
+func (b *slotBody) Close() error {
+	b.once.Do(b.slot.release)
+	return nil
+}
+
+// valuesContext has the values of a context, without its deadline and cancelation
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
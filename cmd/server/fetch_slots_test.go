@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// rpcPostForSlot sends a JSON-RPC request to the RPC proxy of chain 1, for the fetch of a slot
+func rpcPostForSlot(pool *rpcPool, slot *fetchSlot) int {
+	w := httptest.NewRecorder()
+	path := fmt.Sprintf("/chain/1/%d", slot.id)
+	pool.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`)))
+	return w.Code
+}
+
+// acquireSlot acquires a slot of a pool, which must not be full
+func acquireSlot(t *testing.T, pool *fetchSlotPool, ctx context.Context) *fetchSlot {
+	slot, err := pool.acquire(ctx)
+	assert.NoError(t, err)
+	return slot
+}
+
+func TestFetchSlots(t *testing.T) {
+	defer func(exporter *spanBatcher) { spanExporter = exporter }(spanExporter)
+	exported := make(chan []*span, 1)
+	spanExporter = newSpanBatcher(func(spans []*span) error {
+		exported <- spans
+		return nil
+	})
+	_, server := newRPCStandIn(t, 1, 100)
+	pool := newRPCPool(1, []RPCEndpoint{{URL: server.URL}})
+
+	// The RPC calls of a fetch are counted and traced as part of it, even with other fetches in flight
+	req := httptest.NewRequest("GET", "http://vitalik.eth.1.w3link.io/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, fetchSpan := startServerSpan(req, "GET")
+	info := &requestInfo{}
+	slot := acquireSlot(t, fetchSlots, context.WithValue(ctx, requestInfoKey{}, info))
+	otherInfo := &requestInfo{}
+	other := acquireSlot(t, fetchSlots, context.WithValue(context.Background(), requestInfoKey{}, otherInfo))
+	assert.NotEqual(t, slot.id, other.id)
+	assert.Equal(t, http.StatusOK, rpcPostForSlot(pool, slot))
+	assert.Equal(t, http.StatusOK, rpcPostForSlot(pool, other))
+	assert.Equal(t, http.StatusOK, rpcPostForSlot(pool, other))
+	fetchSpan.finish()
+	spanExporter.close()
+	children := 0
+	for _, s := range <-exported {
+		if s.parentId == fetchSpan.spanId {
+			assert.Equal(t, "rpc eth_call", s.name)
+			children++
+		}
+	}
+	assert.Equal(t, 1, children)
+	assert.Equal(t, uint64(1), info.rpcCalls)
+	assert.Equal(t, uint64(2), otherInfo.rpcCalls)
+
+	// Past the deadline of a fetch, its RPC calls are refused
+	fetchCtx, cancel := context.WithCancel(context.WithValue(context.Background(), requestInfoKey{}, info))
+	slot.bind(fetchCtx)
+	cancel()
+	assert.Equal(t, http.StatusGatewayTimeout, rpcPostForSlot(pool, slot))
+	assert.Equal(t, uint64(1), info.rpcCalls)
+
+	// But not those of the reads of its body, which have their own deadline
+	body := slot.body(readerFunc(func(p []byte) (int, error) {
+		assert.Equal(t, http.StatusOK, rpcPostForSlot(pool, slot))
+		return 0, io.EOF
+	}), fetchCtx)
+	_, err := body.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, uint64(2), info.rpcCalls)
+
+	// The slots are reused once their body is closed
+	assert.NoError(t, body.Close())
+	assert.NoError(t, body.Close())
+	_, err = body.Read(make([]byte, 1))
+	assert.Equal(t, io.ErrClosedPipe, err)
+	assert.Nil(t, fetchSlotContext(httptest.NewRequest("POST", fmt.Sprintf("/chain/1/%d", slot.id), nil)))
+	next := context.WithValue(context.Background(), requestInfoKey{}, &requestInfo{})
+	assert.Equal(t, slot, acquireSlot(t, fetchSlots, next))
+	// The reads of a closed body leave the slot to its next fetch
+	_, err = body.Read(make([]byte, 1))
+	assert.Equal(t, io.ErrClosedPipe, err)
+	assert.Equal(t, next, slot.context())
+	slot.release()
+	other.release()
+}
+
+func TestFetchSlotPool(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	pool := newFetchSlotPool(2)
+	pool.now = func() time.Time { return now }
+
+	// The fetches over the size of the pool wait for a free slot, until their deadline
+	first := acquireSlot(t, pool, context.Background())
+	second := acquireSlot(t, pool, context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := pool.acquire(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	acquired := make(chan *fetchSlot)
+	go func() {
+		acquired <- acquireSlot(t, pool, context.Background())
+	}()
+	first.release()
+	assert.Equal(t, first, <-acquired)
+
+	// The slots left free for a while are dropped
+	first.release()
+	now = now.Add(fetchSlotIdleTimeout / 2)
+	second.release()
+	now = now.Add(fetchSlotIdleTimeout/2 + time.Second)
+	assert.Equal(t, second, acquireSlot(t, pool, context.Background()))
+	assert.Len(t, pool.slots, 1)
+	third := acquireSlot(t, pool, context.Background())
+	assert.Equal(t, 3, third.id)
+	assert.Len(t, pool.slots, 2)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+)
+
+var web3UrlRegexp = regexp.MustCompile(`^(?P<protocol>[^:]+)://(?P<hostname>[^:/?#]+)(:(?P<chainId>[^/?#]+))?(?P<path>.*)$`)
+
+// isWeb3Url tells if an URL is an absolute web3:// (or w3://) URL
+func isWeb3Url(url string) bool {
+	lowerUrl := strings.ToLower(url)
+	return strings.HasPrefix(lowerUrl, "web3://") || strings.HasPrefix(lowerUrl, "w3://")
+}
+
+// gatewayBaseHost returns the domain of the gateway (with its port, if any) for a given request host
+// e.g. quark.w3q.w3q-g.w3link.io:8080 -> w3link.io:8080
+func gatewayBaseHost(host string) string {
+	hostname, port := host, ""
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		hostname, port = host[:i], host[i:]
+	}
+	_, gatewayDomain := splitGatewayHost(hostname)
+	return gatewayDomain + port
+}
+
+// web3UrlToGatewayUrl converts a web3:// URL into an URL served by this gateway, using the host
+// routes understood by handleSubdomain. Examples with the default routes, with gatewayHost = w3link.io:
+// web3://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:11155111/index.txt ->
+//
+//	https://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.11155111.w3link.io/index.txt
+//
+// web3://quark.w3q:3334/index.txt -> https://quark.w3q.3334.w3link.io/index.txt
+// web3://dblog.dblog.eth:11155111/ -> https://dblog.dblog.eth.11155111.w3link.io/
+// And with gatewayHost = w3eth.io and default chain = 1:
+// web3://quark.eth/index.txt -> https://quark.w3eth.io/index.txt
+// URLs which cannot be expressed with a subdomain use the path layout:
+// web3://a.b.c.eth:5/index.txt -> https://w3link.io/a.b.c.eth:5/index.txt
+func web3UrlToGatewayUrl(web3Url string, scheme string, gatewayHost string) (string, error) {
+	hostname, chainId, path, err := parseWeb3Url(web3Url)
+	if err != nil {
+		return "", err
+	}
+
+	subdomain := web3HostToSubdomain(hostname, chainId, path)
+	if subdomain != "" {
+		return scheme + "://" + subdomain + "." + gatewayHost + path, nil
+	}
+
+	// Path layout: https://[gateway-host].[gateway-tld]/[web3-host]:[chain]/path
+	// Make the chain explicit when the gateway would otherwise use its default chain instead
+	// of the one implied by the web3:// URL
+	if chainId == "" && config.DefaultChain > 1 {
+		chainId = implicitChainId(hostname)
+	}
+	if chainId != "" {
+		hostname += ":" + chainId
+	}
+	return scheme + "://" + gatewayHost + "/" + hostname + path, nil
+}
+
+// parseWeb3Url splits a web3:// URL into its host name, chain id and path (with the query).
+// The chain may be given by its short name, e.g. web3://quark.eth:gor/index.txt
+func parseWeb3Url(web3Url string) (hostname string, chainId string, path string, err error) {
+	matches := web3UrlRegexp.FindStringSubmatch(web3Url)
+	if matches == nil {
+		return "", "", "", fmt.Errorf("invalid web3 URL %v", web3Url)
+	}
+	protocol := strings.ToLower(matches[web3UrlRegexp.SubexpIndex("protocol")])
+	if protocol != "web3" && protocol != "w3" {
+		return "", "", "", fmt.Errorf("invalid web3 URL protocol %v", protocol)
+	}
+	hostname = matches[web3UrlRegexp.SubexpIndex("hostname")]
+	path = matches[web3UrlRegexp.SubexpIndex("path")]
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	chainId = matches[web3UrlRegexp.SubexpIndex("chainId")]
+	if chainId != "" {
+		chainId = strings.Split(hostChangeChainShortNameToId(hostname+":"+chainId), ":")[1]
+		if id, err := strconv.Atoi(chainId); err != nil || id <= 0 {
+			return "", "", "", fmt.Errorf("invalid chain %v", matches[web3UrlRegexp.SubexpIndex("chainId")])
+		}
+	}
+	return
+}
+
+// web3HostToSubdomain returns the gateway subdomain under which handleSubdomain serves the given
+// web3:// host, or "" if there is none and the path layout must be used
+func web3HostToSubdomain(hostname string, chainId string, path string) string {
+	pathname := strings.SplitN(path, "?", 2)[0]
+	firstPathPart := strings.Split(pathname, "/")[1]
+
+	// Paths starting with a hosted dweb file name are altered by handleSubdomain
+	if common.IsHexAddress(hostname) {
+		if strings.HasSuffix(firstPathPart, ".w3q") || strings.HasSuffix(firstPathPart, ".eth") {
+			return ""
+		}
+	} else if strings.Contains(pathname, "/"+hostname+"/") {
+		return ""
+	}
+
+	for _, route := range hostRoutes() {
+		if subdomainParts, ok := route.render(hostname, chainId); ok {
+			return strings.Join(subdomainParts, ".")
+		}
+	}
+	return ""
+}
+
+// implicitChainId returns the chain id targeted by a web3:// host without explicit chain id:
+// 1 for an address, the default chain of the domain name service for a name, "" if unknown
+func implicitChainId(hostname string) string {
+	if common.IsHexAddress(hostname) {
+		return "1"
+	}
+	hostParts := strings.Split(hostname, ".")
+	if chainId, ok := config.NSDefaultChains[hostParts[len(hostParts)-1]]; ok {
+		return strconv.Itoa(chainId)
+	}
+	return ""
+}
+
+// handleGatewayUrl serves the gateway URL of a web3:// URL
+// e.g. /_api/gateway-url?url=web3://quark.w3q:3334/index.txt on w3link.io returns
+// {"url":"web3://quark.w3q:3334/index.txt","gatewayUrl":"https://quark.w3q.3334.w3link.io/index.txt"}
+func handleGatewayUrl(w http.ResponseWriter, req *http.Request) {
+	gatewayCORS.setHeaders(w.Header(), req)
+	w.Header().Set("Content-Type", "application/json")
+
+	web3Url := req.URL.Query().Get("url")
+	result := map[string]string{"url": web3Url}
+	gatewayUrl, err := web3UrlToGatewayUrl(web3Url, requestScheme(req), gatewayBaseHost(req.Host))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		result["error"] = err.Error()
+	} else {
+		result["gatewayUrl"] = gatewayUrl
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Errorf("Cannot write gateway URL: %v\n", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// randomWeb3Url generates web3:// URLs for property tests
+type randomWeb3Url string
+
+func (randomWeb3Url) Generate(r *rand.Rand, size int) reflect.Value {
+	labels := []string{"quark", "concat", "dblog", "w3url", "a1", "usdt"}
+	pick := func(values []string) string {
+		return values[r.Intn(len(values))]
+	}
+
+	var hostname string
+	switch r.Intn(3) {
+	case 0:
+		address := make([]byte, 20)
+		r.Read(address)
+		hostname = common.BytesToAddress(address).Hex()
+	case 1:
+		hostname = pick(labels) + "." + pick([]string{"eth", "w3q"})
+	default:
+		nameLabels := make([]string, 2+r.Intn(3))
+		for i := range nameLabels {
+			nameLabels[i] = pick(labels)
+		}
+		hostname = strings.Join(nameLabels, ".") + "." + pick([]string{"eth", "w3q"})
+	}
+
+	chain := pick([]string{"", ":1", ":5", ":3334", ":11155111", ":gor", ":w3q-g"})
+
+	path := ""
+	for i := r.Intn(4); i > 0; i-- {
+		path += "/" + pick(append(labels, "index.html", hostname, "balanceOf", "x.w3q"))
+	}
+	if r.Intn(2) == 0 {
+		path += "/"
+	}
+	if r.Intn(3) == 0 {
+		path += "?returns=(uint256)"
+	}
+
+	return reflect.ValueOf(randomWeb3Url("web3://" + hostname + chain + path))
+}
+
+// canonicalWeb3Url makes explicit the chain of a web3:// URL, so that equivalent URLs compare equal
+func canonicalWeb3Url(web3Url string) string {
+	hostname, chainId, path, err := parseWeb3Url(web3Url)
+	if err != nil {
+		return "invalid: " + web3Url
+	}
+	if chainId == "" {
+		chainId = implicitChainId(hostname)
+	}
+	return fmt.Sprintf("web3://%s:%s%s", strings.ToLower(hostname), chainId, path)
+}
+
+// gatewayUrlToWeb3Url does the forward mapping of the gateway, with handleSubdomain
+func gatewayUrlToWeb3Url(gatewayUrl string) (string, error) {
+	u, err := url.Parse(gatewayUrl)
+	if err != nil {
+		return "", err
+	}
+	p, _, err := handleSubdomain(u.Host, u.EscapedPath())
+	if err != nil {
+		return "", err
+	}
+	web3Url := "web3:/" + p
+	if u.RawQuery != "" {
+		web3Url += "?" + u.RawQuery
+	}
+	return web3Url, nil
+}
+
+// Gateway configurations on which the web3:// <-> gateway URL mappings are tested
+var gatewayConfigs = []struct {
+	name           string
+	defaultChain   int
+	gatewayDomains []string
+	hostRoutes     []HostRoute
+	gatewayHost    string
+}{
+	{"w3link", 0, nil, nil, "w3link.io"},
+	{"w3eth", 1, nil, nil, "w3eth.io"},
+	{"w3q", 3334, nil, nil, "w3q.io"},
+	{"custom", 0, []string{"gw.example.co.uk", "web3.corp.internal"}, []HostRoute{
+		{Pattern: "{name}", TLD: "eth", Chain: 5},
+		{Pattern: "{name}.{tld}"},
+		{Pattern: "{address}.{chain}"},
+		{Pattern: "app.{name}.{tld}.{chain}"},
+		{Pattern: "{name}.{name}.{tld}.{chain}"},
+	}, "gw.example.co.uk:8443"},
+}
+
+// withGatewayConfig runs f with the config patched with a gateway configuration
+func withGatewayConfig(defaultChain int, gatewayDomains []string, hostRoutes []HostRoute, f func()) {
+	defer func(defaultChain int, gatewayDomains []string, hostRoutes []HostRoute) {
+		config.DefaultChain, config.GatewayDomains, config.HostRoutes = defaultChain, gatewayDomains, hostRoutes
+	}(config.DefaultChain, config.GatewayDomains, config.HostRoutes)
+	config.DefaultChain, config.GatewayDomains, config.HostRoutes = defaultChain, gatewayDomains, hostRoutes
+	f()
+}
+
+func TestGatewayUrlRoundTrip(t *testing.T) {
+	for _, gatewayConfig := range gatewayConfigs {
+		gatewayHost := gatewayConfig.gatewayHost
+		property := func(web3Url randomWeb3Url) bool {
+			gatewayUrl, err := web3UrlToGatewayUrl(string(web3Url), "https", gatewayHost)
+			if err != nil {
+				t.Logf("%v: %v", web3Url, err)
+				return false
+			}
+			backWeb3Url, err := gatewayUrlToWeb3Url(gatewayUrl)
+			if err != nil {
+				t.Logf("%v -> %v: %v", web3Url, gatewayUrl, err)
+				return false
+			}
+			if canonicalWeb3Url(string(web3Url)) != canonicalWeb3Url(backWeb3Url) {
+				t.Logf("%v -> %v -> %v", web3Url, gatewayUrl, backWeb3Url)
+				return false
+			}
+			return true
+		}
+		t.Run(gatewayConfig.name, func(t *testing.T) {
+			withGatewayConfig(gatewayConfig.defaultChain, gatewayConfig.gatewayDomains, gatewayConfig.hostRoutes, func() {
+				assert.NoError(t, quick.Check(property, &quick.Config{MaxCount: 2000}))
+			})
+		})
+	}
+}
+
+var gatewayUrls = []struct {
+	defaultChain int
+	web3Url      string
+	gatewayUrl   string
+}{
+	{0, "web3://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:11155111/index.txt", "https://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.11155111.w3link.io/index.txt"},
+	{0, "web3://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5/name?returns=(string)", "https://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.1.w3link.io/name?returns=(string)"},
+	{0, "web3://quark.w3q:3334/index.txt", "https://quark.w3q.3334.w3link.io/index.txt"},
+	{0, "web3://quark.eth:gor/index.txt", "https://quark.eth.5.w3link.io/index.txt"},
+	{0, "web3://quark.eth", "https://quark.eth.5.w3link.io/"},
+	{0, "web3://dblog.dblog.eth:11155111/", "https://dblog.dblog.eth.11155111.w3link.io/"},
+	{0, "web3://a.b.c.eth:5/index.txt", "https://w3link.io/a.b.c.eth:5/index.txt"},
+	{0, "web3://concat.w3q:3334/concat.w3q/index.txt", "https://w3link.io/concat.w3q:3334/concat.w3q/index.txt"},
+	{1, "web3://quark.eth/index.txt", "https://quark.w3link.io/index.txt"},
+	{1, "web3://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5/index.txt", "https://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.w3link.io/index.txt"},
+	{1, "web3://quark.w3q:3334/index.txt", "https://w3link.io/quark.w3q:3334/index.txt"},
+	{0, "https://quark.eth/", ""},
+	{0, "web3://quark.eth:unknown/", ""},
+}
+
+func TestWeb3UrlToGatewayUrl(t *testing.T) {
+	for _, test := range gatewayUrls {
+		t.Run(test.web3Url, func(t *testing.T) {
+			withGatewayConfig(test.defaultChain, nil, nil, func() {
+				gatewayUrl, err := web3UrlToGatewayUrl(test.web3Url, "https", "w3link.io")
+				if test.gatewayUrl == "" {
+					assert.Error(t, err)
+				} else {
+					assert.NoError(t, err)
+					assert.Equal(t, test.gatewayUrl, gatewayUrl)
+				}
+			})
+		})
+	}
+}
+
+func TestHandleGatewayUrl(t *testing.T) {
+	defer func(defaultChain int) { config.DefaultChain = defaultChain }(config.DefaultChain)
+	config.DefaultChain = 0
+
+	req := httptest.NewRequest("GET", "/_api/gateway-url?url="+url.QueryEscape("web3://quark.w3q:3334/index.txt"), nil)
+	req.Host = "w3link.io:8080"
+	w := httptest.NewRecorder()
+	handleGatewayUrl(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	result := map[string]string{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	assert.Equal(t, "http://quark.w3q.3334.w3link.io:8080/index.txt", result["gatewayUrl"])
+
+	req = httptest.NewRequest("GET", "/_api/gateway-url?url=quark.w3q", nil)
+	w = httptest.NewRecorder()
+	handleGatewayUrl(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
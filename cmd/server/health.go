@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The operational endpoints of the gateway:
+//   - /_health: liveness, answered as long as the server runs
+//   - /_ready: readiness, once initialized and until shutdown, while the ready chains have a
+//     usable RPC endpoint
+//   - /_status: report of each chain, and of the caches
+
+// initialized is set once the config is loaded and the web3protocol client is created
+var initialized atomic.Bool
+
+var startTime = time.Now()
+
+// readyChains returns the chains which must have a usable RPC endpoint for the gateway to be
+// ready: ReadyChains, or else the default chain, or else all the chains
+func readyChains() []int {
+	if len(config.ReadyChains) > 0 {
+		return config.ReadyChains
+	}
+	if config.DefaultChain != 0 {
+		return []int{config.DefaultChain}
+	}
+	chains := []int{}
+	for chainId := range rpcPools {
+		chains = append(chains, chainId)
+	}
+	sort.Ints(chains)
+	return chains
+}
+
+// chainHealth is the RPC health of a chain, as reported by the readiness endpoint
+type chainHealth struct {
+	Usable      bool     `json:"usable"`
+	Quarantined []string `json:"quarantined,omitempty"`
+}
+
+// isReady tells if the gateway can serve requests: initialized, not shutting down, and the ready
+// chains have a usable RPC endpoint
+func isReady() bool {
+	if !initialized.Load() || shuttingDown.Load() {
+		return false
+	}
+	for _, chainId := range readyChains() {
+		if pool, ok := rpcPools[chainId]; !ok || !pool.usable() {
+			return false
+		}
+	}
+	return true
+}
+
+// handleHealth serves the liveness of the gateway
+func handleHealth(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"alive": true, "uptimeSeconds": int64(time.Since(startTime).Seconds())}); err != nil {
+		log.Errorf("Cannot write liveness: %v\n", err)
+	}
+}
+
+// handleReady serves the readiness of the gateway: 503 until it is initialized, or if one of the
+// ready chains has no usable RPC endpoint. The chains with no usable endpoint, or with endpoints
+// serving another chain, are reported.
+func handleReady(w http.ResponseWriter, req *http.Request) {
+	ready := isReady()
+	unhealthy := map[string]chainHealth{}
+	for chainId, pool := range rpcPools {
+		health := chainHealth{Usable: pool.usable(), Quarantined: pool.quarantined()}
+		if !health.Usable || len(health.Quarantined) > 0 {
+			unhealthy[strconv.Itoa(chainId)] = health
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"ready": ready, "initialized": initialized.Load(), "unhealthyChains": unhealthy}); err != nil {
+		log.Errorf("Cannot write readiness: %v\n", err)
+	}
+}
+
+// chainStatus is the report of a chain at /_status
+type chainStatus struct {
+	ShortNames   []string            `json:"shortNames,omitempty"`
+	Default      bool                `json:"default"`
+	RPCReachable bool                `json:"rpcReachable"` // a usable endpoint
+	LatestBlock  uint64              `json:"latestBlock"`  // over all the endpoints
+	BlockLag     uint64              `json:"blockLag"`     // of the most up-to-date usable endpoint
+	NameServices map[string]nsStatus `json:"nameServices,omitempty"`
+	Endpoints    []rpcEndpointStatus `json:"endpoints"`
+}
+
+// nsStatus is a name service configured on a chain, by suffix
+type nsStatus struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+}
+
+// cacheSizes are the sizes of the caches at /_status
+type cacheSizes struct {
+	ResponseEntries     int   `json:"responseEntries"`
+	ResponseMemoryBytes int64 `json:"responseMemoryBytes"`
+	ResponseDiskBytes   int64 `json:"responseDiskBytes"`
+	CnameEntries        int   `json:"cnameEntries"`
+	CustomDomainEntries int   `json:"customDomainEntries"`
+}
+
+// getChainStatus returns the report of a configured chain
+func getChainStatus(chainConfig ChainConfig) chainStatus {
+	status := chainStatus{Default: chainConfig.ChainID == config.DefaultChain, Endpoints: []rpcEndpointStatus{}}
+	for shortName, chainId := range config.Name2Chain {
+		if chainId == chainConfig.ChainID {
+			status.ShortNames = append(status.ShortNames, shortName)
+		}
+	}
+	sort.Strings(status.ShortNames)
+	if len(chainConfig.NSConfig) > 0 {
+		status.NameServices = map[string]nsStatus{}
+		for suffix, ns := range chainConfig.NSConfig {
+			status.NameServices[suffix] = nsStatus{Type: string(ns.NSType), Address: ns.NSAddr}
+		}
+	}
+	pool, ok := rpcPools[chainConfig.ChainID]
+	if !ok {
+		return status
+	}
+	status.RPCReachable = pool.usable()
+	status.Endpoints = pool.getStatus()
+	bestLag := uint64(0)
+	usable := false
+	for _, endpoint := range status.Endpoints {
+		if endpoint.LatestBlock > status.LatestBlock {
+			status.LatestBlock = endpoint.LatestBlock
+		}
+		if endpoint.Healthy && !endpoint.Quarantined && !endpoint.CircuitOpen && (!usable || endpoint.BlockLag < bestLag) {
+			bestLag, usable = endpoint.BlockLag, true
+		}
+	}
+	status.BlockLag = bestLag
+	return status
+}
+
+// getCacheSizes returns the sizes of the caches
+func getCacheSizes() cacheSizes {
+	sizes := cacheSizes{
+		CnameEntries:        getCnameCache().getStats().Entries,
+		CustomDomainEntries: getCustomDomainRoots().getStats().Entries,
+	}
+	if responses != nil {
+		stats := responses.getStats()
+		sizes.ResponseEntries, sizes.ResponseMemoryBytes, sizes.ResponseDiskBytes = stats.Entries, stats.MemoryBytes, stats.DiskBytes
+	}
+	return sizes
+}
+
+// handleStatus serves the report of each configured chain: RPC reachability, latest block and
+// lag, name services and RPC endpoints, along with the sizes of the caches
+func handleStatus(w http.ResponseWriter, req *http.Request) {
+	chains := map[string]chainStatus{}
+	for _, chainConfig := range config.ChainConfigs {
+		chains[strconv.Itoa(chainConfig.ChainID)] = getChainStatus(chainConfig)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"version":       versionInfo(),
+		"ready":         isReady(),
+		"uptimeSeconds": int64(time.Since(startTime).Seconds()),
+		"chains":        chains,
+		"caches":        getCacheSizes(),
+	})
+	if err != nil {
+		log.Errorf("Cannot write status: %v\n", err)
+	}
+}
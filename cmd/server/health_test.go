@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleReady(t *testing.T) {
+	defer func(pools map[int]*rpcPool, defaultChain int, chains []int) {
+		rpcPools, config.DefaultChain, config.ReadyChains = pools, defaultChain, chains
+	}(rpcPools, config.DefaultChain, config.ReadyChains)
+	_, mainnetServer := newRPCStandIn(t, 1, 1000)
+	_, goerliServer := newRPCStandIn(t, 5, 1000)
+	rpcPools = map[int]*rpcPool{
+		1:        newRPCPool(1, []RPCEndpoint{{URL: mainnetServer.URL}}),
+		11155111: newRPCPool(11155111, []RPCEndpoint{{URL: goerliServer.URL}}),
+	}
+	for _, pool := range rpcPools {
+		pool.checkHealth(context.Background())
+	}
+
+	ready := func() (int, map[string]chainHealth) {
+		w := httptest.NewRecorder()
+		handleReady(w, httptest.NewRequest("GET", "/_ready", nil))
+		var body struct {
+			UnhealthyChains map[string]chainHealth `json:"unhealthyChains"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		return w.Code, body.UnhealthyChains
+	}
+
+	// Not ready until initialized
+	defer initialized.Store(initialized.Load())
+	initialized.Store(false)
+	config.DefaultChain, config.ReadyChains = 1, nil
+	code, _ := ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// The default chain is usable, the other one is reported
+	initialized.Store(true)
+	code, unhealthy := ready()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]chainHealth{"11155111": {Usable: false, Quarantined: []string{goerliServer.URL + " (chain 5)"}}}, unhealthy)
+
+	config.ReadyChains = []int{1, 11155111}
+	code, _ = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestHandleStatus(t *testing.T) {
+	defer func(pools map[int]*rpcPool, chains map[int]ChainConfig, name2Chain map[string]int, defaultChain int) {
+		rpcPools, config.ChainConfigs, config.Name2Chain, config.DefaultChain = pools, chains, name2Chain, defaultChain
+	}(rpcPools, config.ChainConfigs, config.Name2Chain, config.DefaultChain)
+	_, upToDate := newRPCStandIn(t, 1, 1000)
+	_, lagging := newRPCStandIn(t, 1, 990)
+	rpcPools = map[int]*rpcPool{1: newRPCPool(1, []RPCEndpoint{{URL: upToDate.URL}, {URL: lagging.URL}})}
+	rpcPools[1].checkHealth(context.Background())
+	config.ChainConfigs = map[int]ChainConfig{
+		1:        {ChainID: 1, NSConfig: map[string]NameServiceInfo{"eth": {NSType: "ens", NSAddr: "0x00000000000C2E074eC69A0dFb2997BA6C7d2e1e"}}},
+		11155111: {ChainID: 11155111},
+	}
+	config.Name2Chain = map[string]int{"eth": 1, "mainnet": 1, "sep": 11155111}
+	config.DefaultChain = 1
+
+	w := httptest.NewRecorder()
+	handleStatus(w, httptest.NewRequest("GET", "/_status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Chains map[string]chainStatus `json:"chains"`
+		Caches cacheSizes             `json:"caches"`
+	}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	mainnet := body.Chains["1"]
+	assert.Equal(t, []string{"eth", "mainnet"}, mainnet.ShortNames)
+	assert.True(t, mainnet.Default)
+	assert.True(t, mainnet.RPCReachable)
+	assert.Equal(t, uint64(1000), mainnet.LatestBlock)
+	assert.Equal(t, uint64(0), mainnet.BlockLag)
+	assert.Equal(t, map[string]nsStatus{"eth": {Type: "ens", Address: "0x00000000000C2E074eC69A0dFb2997BA6C7d2e1e"}}, mainnet.NameServices)
+	assert.Len(t, mainnet.Endpoints, 2)
+
+	// A chain without RPC pool is reported unreachable
+	assert.False(t, body.Chains["11155111"].RPCReachable)
+	assert.Equal(t, []string{"sep"}, body.Chains["11155111"].ShortNames)
+}
@@ -2,35 +2,72 @@ package main
 
 import (
 	"bufio"
-	"context"
 	"fmt"
-	"net"
 	"os"
 	"strconv"
 	"strings"
-	"time"
 
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/naoina/toml"
-	log "github.com/sirupsen/logrus"
 
 	"github.com/web3-protocol/web3protocol-go"
 )
 
 type Web3Config struct {
-	ServerPort      string
-	Verbosity       int
-	CertificateFile string
-	KeyFile         string
-	RunAsHttp       bool
-	AutoCertEmail   string
-	SystemCertDir   string
-	DefaultChain    int
-	HomePage        string
-	CORS            string
-	NSDefaultChains map[string]int
-	Name2Chain      map[string]int
-	ChainConfigs    map[int]ChainConfig
+	ServerPort                string
+	Verbosity                 int
+	CertificateFile           string
+	KeyFile                   string
+	RunAsHttp                 bool
+	AutoCertEmail             string
+	SystemCertDir             string
+	DefaultChain              int
+	HomePage                  string
+	CORS                      string
+	CORSAllowCredentials      bool
+	CORSExposeHeaders         []string
+	CORSAllowMethods          []string
+	CORSAllowHeaders          []string
+	CORSMaxAge                int
+	RewriteWeb3Links          bool
+	GatewayDomains            []string
+	HostRoutes                []HostRoute
+	CustomDomains             map[string]CustomDomain
+	CustomDomainLookup        bool
+	CustomDomainCacheSeconds  int
+	CNAMELookup               string
+	CNAMECacheSeconds         int
+	CNAMENegativeCacheSeconds int
+	CNAMECacheSize            int
+	DNSLookupTimeoutSeconds   int
+	ResponseCache             ResponseCacheConfig
+	CoalesceFetches           bool
+	MaxConcurrentFetches      int
+	ETagMaxBodyBytes          int64
+	RangeMaxBufferBytes       int64
+	NSDefaultChains           map[string]int
+	Name2Chain                map[string]int
+	ChainConfigs              map[int]ChainConfig
+	RPCTimeoutSeconds         int
+	RPCHealthCheckSeconds     int
+	RPCMaxBlockLag            int
+	RPCFailureThreshold       int
+	RPCCircuitOpenSeconds     int
+	RPCChainIdMismatch        string
+	RPCQueueMillis            int
+	ClientRateLimit           ClientRateLimitConfig
+	TrustedProxies            []string
+	MetricsAddr               string
+	Stats                     StatsConfig
+	AccessLog                 AccessLogConfig
+	Tracing                   TracingConfig
+	ReadyChains               []int
+	ShutdownDelaySeconds      int
+	ShutdownTimeoutSeconds    int
+	ReadHeaderTimeoutSeconds  int
+	ReadTimeoutSeconds        int
+	WriteTimeoutSeconds       int
+	IdleTimeoutSeconds        int
+	RequestTimeoutSeconds     int
 }
 
 type NameServiceInfo struct {
@@ -41,7 +78,13 @@ type NameServiceInfo struct {
 type ChainConfig struct {
 	ChainID  int
 	RPC      string
+	RPCs     []RPCEndpoint
 	NSConfig map[string]NameServiceInfo
+
+	// Budget of the RPC requests of the chain, over all its endpoints
+	RPCRateLimit   float64 // requests per second
+	RPCBurst       int     // default: RPCRateLimit
+	RPCMaxInFlight int
 }
 
 type arrayFlags []string
@@ -106,42 +149,6 @@ func getDefaultNSSuffix() (string, error) {
 	return "", fmt.Errorf("cannot find ns config for default chain %v", config.DefaultChain)
 }
 
-func stats(returnSize int, hostPort string, targetChain string, nsType, path, host string) {
-	point := influxdb2.NewPointWithMeasurement("w3stats").
-		AddTag("chain", getChainById(targetChain)).
-		AddTag("type", nsType).
-		AddField("size", returnSize).
-		SetTime(time.Now())
-	er := writeAPI.WritePoint(context.Background(), point)
-	if er != nil {
-		log.Errorln("db err", er)
-	}
-	ip, _, er := net.SplitHostPort(hostPort)
-	if er != nil {
-		ip = "unknown"
-	}
-	point = influxdb2.NewPointWithMeasurement("w3stats_url").
-		AddTag("url", host).
-		AddField("ip", ip).
-		SetTime(time.Now())
-	er = writeAPI.WritePoint(context.Background(), point)
-	if er != nil {
-		log.Errorln("db err", er)
-	}
-	if path == "/" || path == "/index.html" {
-		if net.ParseIP(host) == nil {
-			point = influxdb2.NewPointWithMeasurement("w3stats_homepage").
-				AddTag("url", host).
-				AddField("ip", ip).
-				SetTime(time.Now())
-			er = writeAPI.WritePoint(context.Background(), point)
-			if er != nil {
-				log.Errorln("db err", er)
-			}
-		}
-	}
-}
-
 func getChainById(chainId string) string {
 	chainIdInt, err := strconv.Atoi(chainId)
 	if err == nil {
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/andybalholm/brotli"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+)
+
+// The script injected in HTML pages:
+// - patching the fetch() JS function so that it works with web3:// URLs
+// - Handling <a> links to absolute web3:// URLs
+// The conversion of web3:// URLs into gateway URLs mirrors web3UrlToGatewayUrl, with the
+// gateway settings given in gatewayConfig
+var web3UrlPatchScriptTemplate = template.Must(template.New("patch").Parse(`
+		<script>
+			(function() {
+				const gatewayConfig = {{.}};
+
+				// Chain id targeted by a web3:// host without explicit chain id
+				const implicitChainId = function(hostname) {
+					if(/^0x[0-9a-fA-F]{40}$/.test(hostname)) {
+						return "1";
+					}
+					let tld = hostname.split('.').pop();
+					if(gatewayConfig.nsDefaultChains[tld] !== undefined) {
+						return String(gatewayConfig.nsDefaultChains[tld]);
+					}
+					return "";
+				}
+
+				// Subdomain under which a host route (see HostRoute) serves a web3:// host, or null
+				const renderHostRoute = function(route, hostname, chainId) {
+					const count = placeholder => route.labels.filter(label => label == placeholder).length;
+					const isAddress = /^0x[0-9a-fA-F]{40}$/.test(hostname);
+					if(isAddress != (count("{address}") > 0)) {
+						return null;
+					}
+					let names = [], tld = "";
+					if(!isAddress) {
+						names = hostname.split('.');
+						if(names.length != count("{name}") + 1) {
+							return null;
+						}
+						tld = names.pop();
+						if(count("{tld}") == 0 && (route.tld == "" || route.tld != tld)) {
+							return null;
+						}
+					}
+					if(count("{chain}") > 0) {
+						chainId = chainId || implicitChainId(hostname);
+						if(chainId == "") {
+							return null;
+						}
+					}
+					else {
+						let routeChainId = isAddress ? route.addressChain : route.chain;
+						if(routeChainId == 0) {
+							if(isAddress || chainId != "") {
+								return null;
+							}
+						}
+						else if(chainId == "") {
+							if(implicitChainId(hostname) != String(routeChainId)) {
+								return null;
+							}
+						}
+						else if(chainId != String(routeChainId)) {
+							return null;
+						}
+					}
+					return route.labels.map(function(label) {
+						switch(label) {
+							case "{address}": return hostname;
+							case "{name}": return names.shift();
+							case "{tld}": return tld;
+							case "{chain}": return chainId;
+							default: return label;
+						}
+					}).join('.');
+				}
+
+				// Gateway subdomain serving a web3:// host, or "" if the path layout must be used
+				const web3HostToSubdomain = function(hostname, chainId, path) {
+					let pathname = path.split('?')[0];
+					let firstPathPart = pathname.split('/')[1];
+					if(/^0x[0-9a-fA-F]{40}$/.test(hostname)) {
+						if(firstPathPart.endsWith('.w3q') || firstPathPart.endsWith('.eth')) {
+							return "";
+						}
+					}
+					else if(pathname.includes("/" + hostname + "/")) {
+						return "";
+					}
+					for(const route of gatewayConfig.hostRoutes) {
+						let subdomain = renderHostRoute(route, hostname, chainId);
+						if(subdomain !== null) {
+							return subdomain;
+						}
+					}
+					return "";
+				}
+
+				// Gateway domain (with port) of the current page
+				const gatewayHost = function() {
+					let hostname = window.location.hostname;
+					let gatewayDomain = "";
+					for(let domain of gatewayConfig.gatewayDomains) {
+						domain = domain.toLowerCase().replace(/^\.+|\.+$/g, '');
+						if(domain.length > gatewayDomain.length && (hostname.toLowerCase() == domain || hostname.toLowerCase().endsWith("." + domain))) {
+							gatewayDomain = domain;
+						}
+					}
+					gatewayDomain = gatewayDomain ? hostname.slice(-gatewayDomain.length) : hostname.split('.').slice(-2).join('.');
+					return gatewayDomain + (window.location.port ? ':' + window.location.port : '');
+				}
+
+				// Web3:// URL to Gateway URL convertor
+				const convertWeb3UrlToGatewayUrl = function(web3Url) {
+					// Parse the URL
+					let matchResult = web3Url.match(/^(?<protocol>[^:]+):\/\/(?<hostname>[^:/?#]+)(:(?<chainId>[^/?#]+))?(?<path>.*)$/)
+					if(matchResult == null) {
+						// Invalid web3:// URL
+						return null;
+					}
+					let urlMainParts = matchResult.groups
+
+					// Check protocol name
+					if(["web3", "w3"].includes(urlMainParts.protocol.toLowerCase()) == false) {
+						// Bad protocol name"
+						return null;
+					}
+
+					// Chain: short names are converted into chain ids
+					let chainId = urlMainParts.chainId ?? "";
+					if(gatewayConfig.name2Chain[chainId] !== undefined) {
+						chainId = String(gatewayConfig.name2Chain[chainId]);
+					}
+					if(chainId != "" && /^[1-9][0-9]*$/.test(chainId) == false) {
+						return null;
+					}
+					let path = urlMainParts.path ?? "";
+					if(path.startsWith("/") == false) {
+						path = "/" + path;
+					}
+
+					let gateway = gatewayHost();
+					let subdomain = web3HostToSubdomain(urlMainParts.hostname, chainId, path);
+					if(subdomain) {
+						return window.location.protocol + "//" + subdomain + "." + gateway + path;
+					}
+
+					// Path layout
+					if(chainId == "" && gatewayConfig.defaultChain > 1) {
+						chainId = implicitChainId(urlMainParts.hostname);
+					}
+					return window.location.protocol + "//" + gateway + "/" + urlMainParts.hostname + (chainId ? ":" + chainId : "") + path;
+				}
+
+
+				// Wrap the fetch() function to convert web3:// URLs into gateway URLs
+				const originalFetch = fetch;
+				fetch = function(input, init) {
+					// Process absolute web3:// URLS: convert them into gateway HTTP RULS
+					if (typeof input === 'string' && input.startsWith('web3://')) {
+						const convertedUrl = convertWeb3UrlToGatewayUrl(input);
+						if(convertedUrl) {
+							console.log('Gateway fetch() wrapper: Converted ' + input + ' to ' + convertedUrl);
+							input = convertedUrl;
+						}
+					}
+
+					// Pipe through the original fetch function
+					return originalFetch(input, init);
+				};
+
+
+				// Listen for clicks on <a> tags, and convert web3:// URLs into gateway URLs
+				document.addEventListener('click', function(event) {
+					if(event.target.tagName === 'A' && event.target.href.startsWith('web3://')) {
+						event.preventDefault();
+						const convertedUrl = convertWeb3UrlToGatewayUrl(event.target.href);
+						if(convertedUrl == null) {
+							console.log("A tag click wrapper: Unable to convert web3:// URL: " + event.target.href);
+							return;
+						}
+						console.log('A tag click wrapper: Converted ' + event.target.href + ' to ' + convertedUrl);
+						window.location.href = convertedUrl;
+					}
+				});
+			})();
+		</script>
+	`))
+
+// The gateway settings used by the injected script
+type patchScriptConfig struct {
+	DefaultChain    int                    `json:"defaultChain"`
+	NSDefaultChains map[string]int         `json:"nsDefaultChains"`
+	Name2Chain      map[string]int         `json:"name2Chain"`
+	GatewayDomains  []string               `json:"gatewayDomains"`
+	HostRoutes      []patchScriptHostRoute `json:"hostRoutes"`
+}
+
+// A HostRoute, with its implicit TLD and chains resolved
+type patchScriptHostRoute struct {
+	Labels       []string `json:"labels"`
+	TLD          string   `json:"tld"`
+	Chain        int      `json:"chain"`
+	AddressChain int      `json:"addressChain"`
+}
+
+var (
+	web3UrlPatchScript     string
+	web3UrlPatchScriptOnce sync.Once
+)
+
+// patchScript returns the script injected in HTML pages, generated from the config
+func patchScript() string {
+	web3UrlPatchScriptOnce.Do(func() {
+		scriptConfig := patchScriptConfig{
+			DefaultChain:    config.DefaultChain,
+			NSDefaultChains: config.NSDefaultChains,
+			Name2Chain:      config.Name2Chain,
+			GatewayDomains:  append([]string{}, config.GatewayDomains...),
+			HostRoutes:      []patchScriptHostRoute{},
+		}
+		for _, route := range hostRoutes() {
+			tld, _ := route.tld()
+			scriptConfig.HostRoutes = append(scriptConfig.HostRoutes, patchScriptHostRoute{
+				Labels:       route.labels(),
+				TLD:          tld,
+				Chain:        route.Chain,
+				AddressChain: route.addressChain(),
+			})
+		}
+		// JSON encoding escapes "<" and ">", so the config cannot close the <script> tag
+		jsonConfig, err := json.Marshal(scriptConfig)
+		var script strings.Builder
+		if err == nil {
+			err = web3UrlPatchScriptTemplate.Execute(&script, string(jsonConfig))
+		}
+		if err != nil {
+			log.Errorf("Cannot generate the HTML patch script: %v\n", err)
+		}
+		web3UrlPatchScript = script.String()
+	})
+	return web3UrlPatchScript
+}
+
+// isHTMLContentType tells if a Content-Type header value designates an HTML document
+// e.g. "text/html", "text/html; charset=utf-8"
+func isHTMLContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/html"
+}
+
+// isSupportedContentEncoding tells if rewriteHTML is able to decode and re-encode a body
+// with the given Content-Encoding header value
+func isSupportedContentEncoding(contentEncoding string) bool {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity", "gzip", "x-gzip", "deflate", "br":
+		return true
+	}
+	return false
+}
+
+// rewriteHTML streams an HTML document from src to dst, injecting the patchScript() script at the
+// start of the <head> element. The document is tokenized, so that the <head> tag is found
+// whatever the way the body is split into chunks, and whatever its attributes. If there is
+// no <head> tag, the script is inserted before the first element which is not <html>, which
+// browsers then place in an implied <head>.
+// If rewriteLink is not nil, it is called on every web3:// URL found in link attributes and
+// stylesheets, and the URL is replaced by its result.
+// If contentEncoding is gzip, deflate or br, the data is transparently decompressed and
+// recompressed with the same encoding.
+func rewriteHTML(dst io.Writer, src io.Reader, contentEncoding string, rewriteLink func(string) string) (err error) {
+	contentEncoding = strings.ToLower(strings.TrimSpace(contentEncoding))
+
+	decoded, encoder, err := newContentCodec(dst, src, contentEncoding)
+	if err != nil {
+		return err
+	}
+
+	err = rewriteHTMLTokens(encoder, decoded, rewriteLink)
+	if closeErr := encoder.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rewriteHTMLTokens does the work of rewriteHTML on decoded data.
+func rewriteHTMLTokens(dst io.Writer, src io.Reader, rewriteLink func(string) string) error {
+	z := html.NewTokenizer(src)
+	written, injected, inStyle := false, false, false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return z.Err()
+			}
+			// No element found at all: append the script, unless the document is empty
+			if written && !injected {
+				_, err := io.WriteString(dst, patchScript())
+				return err
+			}
+			return nil
+		}
+
+		raw := z.Raw()
+		injectBefore, injectAfter := false, false
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			// TagName() lowercases the tag name in place: keep the original bytes
+			raw = append([]byte(nil), raw...)
+			var name string
+			if rewriteLink != nil {
+				token := z.Token()
+				name = token.Data
+				if rewriteTagLinks(&token, rewriteLink) {
+					raw = []byte(token.String())
+				}
+			} else {
+				tagName, _ := z.TagName()
+				name = string(tagName)
+			}
+			inStyle = name == "style" && tt == html.StartTagToken
+			switch name {
+			case "html":
+			case "head":
+				injectAfter = !injected
+			default:
+				injectBefore = !injected
+			}
+		case html.EndTagToken:
+			inStyle = false
+			injectBefore = !injected
+		case html.TextToken:
+			if inStyle && rewriteLink != nil {
+				raw = []byte(rewriteCSSLinks(string(raw), rewriteLink))
+			}
+			injectBefore = !injected && strings.TrimSpace(string(raw)) != ""
+		}
+
+		if injectBefore {
+			if _, err := io.WriteString(dst, patchScript()); err != nil {
+				return err
+			}
+		}
+		if _, err := dst.Write(raw); err != nil {
+			return err
+		}
+		written = true
+		if injectAfter {
+			if _, err := io.WriteString(dst, patchScript()); err != nil {
+				return err
+			}
+		}
+		injected = injected || injectBefore || injectAfter
+
+		// Script injected, and no links to rewrite: the rest of the document is copied as is
+		if injected && rewriteLink == nil {
+			if _, err := dst.Write(z.Buffered()); err != nil {
+				return err
+			}
+			_, err := io.Copy(dst, src)
+			return err
+		}
+	}
+}
+
+// Attributes whose value is a single URL
+var linkAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"poster":     true,
+	"data":       true,
+	"background": true,
+}
+
+var (
+	cssUrlRegexp     = regexp.MustCompile(`(?i)(url\(\s*['"]?)((?:web3|w3)://[^'")\s]*)`)
+	cssImportRegexp  = regexp.MustCompile(`(?i)(@import\s+['"])((?:web3|w3)://[^'"\s]*)`)
+	metaRefreshRegex = regexp.MustCompile(`(?i)^(\s*[0-9.]*\s*[;,]\s*url\s*=\s*['"]?)((?:web3|w3)://[^'"\s]*)`)
+)
+
+// rewriteTagLinks replaces the web3:// URLs found in the attributes of a tag, and tells if
+// the tag was changed
+func rewriteTagLinks(token *html.Token, rewriteLink func(string) string) (changed bool) {
+	isMetaRefresh := false
+	if token.Data == "meta" {
+		for _, attr := range token.Attr {
+			if strings.ToLower(attr.Key) == "http-equiv" && strings.ToLower(strings.TrimSpace(attr.Val)) == "refresh" {
+				isMetaRefresh = true
+			}
+		}
+	}
+
+	for i, attr := range token.Attr {
+		newVal := attr.Val
+		switch {
+		case linkAttributes[attr.Key]:
+			if isWeb3Url(strings.TrimSpace(attr.Val)) {
+				newVal = rewriteLink(strings.TrimSpace(attr.Val))
+			}
+		case attr.Key == "srcset":
+			newVal = rewriteSrcset(attr.Val, rewriteLink)
+		case attr.Key == "style":
+			newVal = rewriteCSSLinks(attr.Val, rewriteLink)
+		case attr.Key == "content" && isMetaRefresh:
+			newVal = metaRefreshRegex.ReplaceAllStringFunc(attr.Val, func(match string) string {
+				parts := metaRefreshRegex.FindStringSubmatch(match)
+				return parts[1] + rewriteLink(parts[2])
+			})
+		}
+		if newVal != attr.Val {
+			token.Attr[i].Val = newVal
+			changed = true
+		}
+	}
+	return
+}
+
+// rewriteSrcset replaces the web3:// URLs of a srcset attribute
+// e.g. "web3://a.eth/img.png 1x, web3://a.eth/img-2x.png 2x"
+func rewriteSrcset(srcset string, rewriteLink func(string) string) string {
+	changed := false
+	candidates := strings.Split(srcset, ",")
+	for i, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		if len(fields) > 0 && isWeb3Url(fields[0]) {
+			fields[0] = rewriteLink(fields[0])
+			leadingSpaces := candidate[:len(candidate)-len(strings.TrimLeft(candidate, " \t\n\r\f"))]
+			candidates[i] = leadingSpaces + strings.Join(fields, " ")
+			changed = true
+		}
+	}
+	if !changed {
+		return srcset
+	}
+	return strings.Join(candidates, ",")
+}
+
+// rewriteCSSLinks replaces the web3:// URLs of url() and @import in a stylesheet
+func rewriteCSSLinks(css string, rewriteLink func(string) string) string {
+	for _, re := range []*regexp.Regexp{cssUrlRegexp, cssImportRegexp} {
+		css = re.ReplaceAllStringFunc(css, func(match string) string {
+			parts := re.FindStringSubmatch(match)
+			return parts[1] + rewriteLink(parts[2])
+		})
+	}
+	return css
+}
+
+// newContentCodec returns a reader of the decoded content of src, and a writer encoding
+// data into dst with the same content encoding. The writer must be closed once done.
+func newContentCodec(dst io.Writer, src io.Reader, contentEncoding string) (io.Reader, io.WriteCloser, error) {
+	switch contentEncoding {
+	case "", "identity":
+		return src, nopWriteCloser{dst}, nil
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot initiate gzip decompression: %v", err)
+		}
+		return reader, gzip.NewWriter(dst), nil
+	case "deflate":
+		// "deflate" is supposed to be zlib-wrapped, but some servers send raw deflate data
+		bufferedSrc := bufio.NewReader(src)
+		header, _ := bufferedSrc.Peek(2)
+		if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			reader, err := zlib.NewReader(bufferedSrc)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot initiate deflate decompression: %v", err)
+			}
+			return reader, zlib.NewWriter(dst), nil
+		}
+		writer, _ := flate.NewWriter(dst, flate.DefaultCompression)
+		return flate.NewReader(bufferedSrc), writer, nil
+	case "br":
+		return brotli.NewReader(src), brotli.NewWriter(dst), nil
+	}
+	return nil, nil, fmt.Errorf("unsupported content encoding %v", contentEncoding)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+)
+
+var htmlRewrites = []struct {
+	name   string
+	input  string
+	expect string
+}{
+	{"head", "<html><head><title>t</title></head></html>", "<html><head>{script}<title>t</title></head></html>"},
+	{"head with attributes", "<!DOCTYPE html>\n<html lang=\"en\">\n<HEAD lang=\"en\" id=x><meta charset=utf-8></HEAD>", "<!DOCTYPE html>\n<html lang=\"en\">\n<HEAD lang=\"en\" id=x>{script}<meta charset=utf-8></HEAD>"},
+	{"no head", "<!DOCTYPE html><!-- <head> --><html><body>hi</body></html>", "<!DOCTYPE html><!-- <head> --><html>{script}<body>hi</body></html>"},
+	{"no tags", "hello", "{script}hello"},
+	{"only doctype", "<!DOCTYPE html>", "<!DOCTYPE html>{script}"},
+	{"empty", "", ""},
+}
+
+func encodeBody(t *testing.T, contentEncoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch contentEncoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		return data
+	}
+	_, err := w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func decodeBody(t *testing.T, contentEncoding string, data []byte) []byte {
+	var r io.Reader
+	var err error
+	switch contentEncoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	case "raw-deflate":
+		r = flate.NewReader(bytes.NewReader(data))
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(data))
+	default:
+		return data
+	}
+	assert.NoError(t, err)
+	decoded, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return decoded
+}
+
+func TestRewriteHTML(t *testing.T) {
+	for _, encoding := range []string{"", "gzip", "deflate", "raw-deflate", "br"} {
+		for _, test := range htmlRewrites {
+			t.Run(encoding+"/"+test.name, func(t *testing.T) {
+				headerValue := encoding
+				if encoding == "raw-deflate" {
+					headerValue = "deflate"
+				}
+				// Feed the body one byte at a time, so that every token spans several reads
+				src := iotest.OneByteReader(bytes.NewReader(encodeBody(t, encoding, []byte(test.input))))
+				var dst bytes.Buffer
+				err := rewriteHTML(&dst, src, headerValue, nil)
+				assert.NoError(t, err)
+				if test.input == "" && encoding != "" {
+					return
+				}
+				assert.Equal(t, strings.Replace(test.expect, "{script}", patchScript(), 1), string(decodeBody(t, encoding, dst.Bytes())))
+			})
+		}
+	}
+}
+
+func TestRewriteHTMLLargeBody(t *testing.T) {
+	body := "<html><head></head><body>" + strings.Repeat("<p>web3</p>", 2*1024*1024) + "</body></html>"
+	var dst bytes.Buffer
+	err := rewriteHTML(&dst, bytes.NewReader(encodeBody(t, "gzip", []byte(body))), "gzip", nil)
+	assert.NoError(t, err)
+	expect := strings.Replace(body, "<head>", "<head>"+patchScript(), 1)
+	assert.Equal(t, expect, string(decodeBody(t, "gzip", dst.Bytes())))
+}
+
+func TestIsHTMLContentType(t *testing.T) {
+	assert.True(t, isHTMLContentType("text/html"))
+	assert.True(t, isHTMLContentType("text/html; charset=utf-8"))
+	assert.False(t, isHTMLContentType("text/plain"))
+	assert.False(t, isHTMLContentType(""))
+}
+
+func TestRewriteHTMLLinks(t *testing.T) {
+	rewriteLink := func(link string) string {
+		return "https://gw/" + strings.SplitN(link, "://", 2)[1]
+	}
+	input := `<html><head><link rel="stylesheet" href="web3://a.eth/s.css">` +
+		`<meta http-equiv="Refresh" content="5; url=web3://a.eth/next">` +
+		`<style>body { background: url("web3://a.eth/bg.png") } @import 'w3://b.eth/x.css';</style></head>` +
+		`<body><img src="web3://a.eth/i.png" srcset="web3://a.eth/i.png 1x, /local.png 2x">` +
+		`<a href="https://example.com/">e</a><div style="background-image: url(web3://a.eth/d.png)"></div>` +
+		`<form action="web3://a.eth/submit"></form><script>fetch("web3://a.eth/keep")</script></body></html>`
+	expect := `<html><head>` + patchScript() + `<link rel="stylesheet" href="https://gw/a.eth/s.css">` +
+		`<meta http-equiv="Refresh" content="5; url=https://gw/a.eth/next">` +
+		`<style>body { background: url("https://gw/a.eth/bg.png") } @import 'https://gw/b.eth/x.css';</style></head>` +
+		`<body><img src="https://gw/a.eth/i.png" srcset="https://gw/a.eth/i.png 1x, /local.png 2x">` +
+		`<a href="https://example.com/">e</a><div style="background-image: url(https://gw/a.eth/d.png)"></div>` +
+		`<form action="https://gw/a.eth/submit"></form><script>fetch("web3://a.eth/keep")</script></body></html>`
+	var dst bytes.Buffer
+	err := rewriteHTML(&dst, iotest.OneByteReader(strings.NewReader(input)), "", rewriteLink)
+	assert.NoError(t, err)
+	assert.Equal(t, expect, dst.String())
+}
@@ -11,9 +11,6 @@ import (
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/http2"
 
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"github.com/influxdata/influxdb-client-go/v2/api"
-
 	"github.com/ethereum/go-ethereum/common"
 
 	"github.com/web3-protocol/web3protocol-go"
@@ -25,7 +22,6 @@ var (
 	versionCheck                  = flag.Bool("version", false, "print version of web3url server")
 	dbToken                       = flag.String("dbToken", "", "influxDB auth token")
 	cacheDurationMinutes          = flag.Int("cacheDurationMinutes", 60, "cache duration in minutes; default to 60")
-	writeAPI                      api.WriteAPIBlocking
 	certificateFile               = stringFlags{}
 	keyFile                       = stringFlags{}
 	port                          = stringFlags{value: "80"}
@@ -48,14 +44,14 @@ func versionInfo() string {
 }
 
 func initConfig() {
-	flag.Var(&chainInfos, "setChain", "chainID,chainName,rpc")
+	flag.Var(&chainInfos, "setChain", "chainID,chainName,rpc[,rpc...]")
 	flag.Var(&nsInfos, "setNS", "chainId,suffix,nsType,nsAddress")
 	flag.Var(&nsChains, "setNSChain", "suffix,defaultChainID")
 	flag.Var(&port, "port", "server port")
 	flag.Var(&keyFile, "key", "key file")
 	flag.Var(&defaultChain, "defaultChain", "default chain id")
 	flag.Var(&homePage, "homePage", "home page address")
-	flag.Var(&cors, "cors", "comma separated list of domains from which to accept cross origin requests")
+	flag.Var(&cors, "cors", "comma separated list of origins from which to accept cross origin requests, e.g. https://ourproject.org,https://*.ourproject.org")
 	flag.Parse()
 
 	// read from config file
@@ -92,10 +88,32 @@ func initConfig() {
 	if cors.set {
 		config.CORS = cors.value
 	}
+	initCORSPolicy()
+	if err := validateHostRoutes(); err != nil {
+		log.Fatalf("Invalid host routes: %v\n", err)
+	}
+	if err := validateCustomDomains(); err != nil {
+		log.Fatalf("Invalid custom domains: %v\n", err)
+	}
+	if err := validateCnameLookup(); err != nil {
+		log.Fatalf("Invalid config: %v\n", err)
+	}
+	if err := validateRPCChainIdMismatch(); err != nil {
+		log.Fatalf("Invalid config: %v\n", err)
+	}
+	if err := validateTrustedProxies(); err != nil {
+		log.Fatalf("Invalid config: %v\n", err)
+	}
+	if err := validateStatsSink(); err != nil {
+		log.Fatalf("Invalid config: %v\n", err)
+	}
+	if err := validateTracing(); err != nil {
+		log.Fatalf("Invalid config: %v\n", err)
+	}
 	for _, c := range chainInfos {
 		ss := strings.Split(c, ",")
-		if len(ss) != 3 {
-			log.Fatalf("Expect 3 fields in chainInfo but got %v\n", len(ss))
+		if len(ss) < 3 {
+			log.Fatalf("Expect at least 3 fields in chainInfo but got %v\n", len(ss))
 			return
 		}
 		chainId, err := strconv.Atoi(ss[0])
@@ -103,9 +121,14 @@ func initConfig() {
 			log.Fatalf("Unable to parse %v as an integer\n", ss[0])
 			return
 		}
+		// The RPC endpoints are tried in order
+		rpcs := []RPCEndpoint{}
+		for i, rpc := range ss[2:] {
+			rpcs = append(rpcs, RPCEndpoint{URL: rpc, Priority: i})
+		}
 		config.ChainConfigs[chainId] = ChainConfig{
 			ChainID:  chainId,
-			RPC:      ss[2],
+			RPCs:     rpcs,
 			NSConfig: make(map[string]NameServiceInfo),
 		}
 		config.Name2Chain[ss[1]] = chainId
@@ -149,6 +172,9 @@ func initConfig() {
 }
 
 func initWeb3protocolClient() {
+	// The RPC of each chain is a local proxy to its RPC endpoints
+	rpcProxyUrls := initRPCPools()
+
 	// Prepare config
 	web3pConfig := web3protocol.Config{
 		Chains:             map[int]web3protocol.ChainConfig{},
@@ -159,7 +185,7 @@ func initWeb3protocolClient() {
 		// Config the chain
 		web3pChainConfig := web3protocol.ChainConfig{
 			ChainId:            chainConfig.ChainID,
-			RPC:                chainConfig.RPC,
+			RPC:                rpcProxyUrls[chainConfig.ChainID],
 			DomainNameServices: map[web3protocol.DomainNameService]web3protocol.DomainNameServiceChainConfig{},
 		}
 
@@ -210,15 +236,7 @@ func initWeb3protocolClient() {
 
 	// Create the web3:// client
 	web3protocolClient = web3protocol.NewClient(&web3pConfig)
-}
-
-func initStats() {
-	if len(*dbToken) > 0 {
-		client := influxdb2.NewClient("http://localhost:8086", *dbToken)
-		writeAPI = client.WriteAPIBlocking("web3q", "bucket0")
-		defer client.Close()
-		web3protocolClient.DomainNameResolutionCache.SetTracer(writeAPI)
-	}
+	fetchSlots = newFetchSlotPool(config.MaxConcurrentFetches)
 }
 
 func main() {
@@ -228,11 +246,27 @@ func main() {
 	}
 	initConfig()
 	initWeb3protocolClient()
+	initResponseCache()
+	initClientLimiter()
 	initStats()
+	initAccessLog()
+	initTracing()
+	initialized.Store(true)
 	log.SetLevel(log.Level(config.Verbosity))
 	log.SetFormatter(&log.TextFormatter{TimestampFormat: "2006-01-02 15:04:05", FullTimestamp: true})
 	log.Infof("config: %+v\n", config)
-	http.HandleFunc("/", handle)
+	http.HandleFunc("/", instrument(handle))
+	http.HandleFunc("/_api/gateway-url", handleGatewayUrl)
+	adminMux.HandleFunc("/_api/cname-cache", handleCnameCacheStats)
+	adminMux.HandleFunc("/_api/response-cache", handleResponseCacheStats)
+	adminMux.HandleFunc("/_api/fetch-coalescing", handleFetchCoalescingStats)
+	adminMux.HandleFunc("/_api/rpc-endpoints", handleRPCStatus)
+	adminMux.HandleFunc("/_api/rpc-throttling", handleRPCThrottlingStats)
+	adminMux.HandleFunc("/_api/client-rate-limit", handleClientRateLimitStats)
+	http.HandleFunc("/_health", handleHealth)
+	http.HandleFunc("/_ready", handleReady)
+	http.HandleFunc("/_status", handleStatus)
+	initMetrics()
 	http.HandleFunc("/_version", func(w http.ResponseWriter, req *http.Request) {
 		_, err := fmt.Fprintf(w, "web3url server version %s", versionInfo())
 		if err != nil {
@@ -244,14 +278,11 @@ func main() {
 	if config.RunAsHttp {
 		log.Infof("Serving on http://localhost:%v\n", config.ServerPort)
 		log.Info("Running server in unsecure mode...")
-		err := http.ListenAndServe(":"+config.ServerPort, nil)
-		if err != nil {
-			log.Fatalf("Cannot start server: %v\n", err)
-			return
-		}
+		server := setServerTimeouts(&http.Server{Addr: ":" + config.ServerPort})
+		serve(server, server.ListenAndServe)
 	} else {
 		log.Infof("Serving on https mode ")
-		server := &http.Server{
+		server := setServerTimeouts(&http.Server{
 			Addr: ":https",
 			TLSConfig: &tls.Config{
 				GetCertificate: GetCertificate,
@@ -259,16 +290,16 @@ func main() {
 				MinVersion:     tls.VersionTLS12,
 			},
 			MaxHeaderBytes: 32 << 20,
-		}
+		})
 
-		go http.ListenAndServe(":http", certManager.HTTPHandler(nil)) // 支持 http-01
+		acmeServer := setServerTimeouts(&http.Server{Addr: ":http", Handler: certManager.HTTPHandler(nil)}) // 支持 http-01
+		serve(acmeServer, acmeServer.ListenAndServe)
 
-		if err := server.ListenAndServeTLS("", ""); err != nil {
-			log.Fatalf("Cannot start server: %v\n", err)
-		}
+		serve(server, func() error { return server.ListenAndServeTLS("", "") })
 		// err := http.ListenAndServeTLS(":"+config.ServerPort, config.CertificateFile, config.KeyFile, nil)
 		// if err != nil {
 		// log.Fatalf("Cannot start server: %v\n", err)
 		// }
 	}
+	waitForShutdown()
 }
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The metrics of the gateway, served at /metrics in the Prometheus text exposition format:
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// metric is a metric family, written at each scrape
+type metric interface {
+	write(w io.Writer)
+}
+
+var metricsRegistry []metric
+
+// Latency buckets, in seconds: from 5ms to 30s
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// counterVec is a counter, by label values
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name string, help string, labelNames ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labelNames: labelNames, values: map[string]*counterValue{}}
+	metricsRegistry = append(metricsRegistry, c)
+	return c
+}
+
+func (c *counterVec) add(delta float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	value, ok := c.values[key]
+	if !ok {
+		value = &counterValue{labelValues: labelValues}
+		c.values[key] = value
+	}
+	value.value += delta
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeMetricHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		value := c.values[key]
+		writeSample(w, c.name, c.labelNames, value.labelValues, value.value)
+	}
+}
+
+// histogramVec is a histogram, by label values
+type histogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64 // upper bounds, sorted
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64 // by bucket, not cumulative
+	sum         float64
+	count       uint64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labelNames ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labelNames: labelNames, buckets: buckets, values: map[string]*histogramValue{}}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		v.counts[i]++
+	}
+	v.sum += value
+	v.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	bucketLabelNames := append(append([]string{}, h.labelNames...), "le")
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += v.counts[i]
+			writeSample(w, h.name+"_bucket", bucketLabelNames, append(append([]string{}, v.labelValues...), formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", bucketLabelNames, append(append([]string{}, v.labelValues...), "+Inf"), float64(v.count))
+		writeSample(w, h.name+"_sum", h.labelNames, v.labelValues, v.sum)
+		writeSample(w, h.name+"_count", h.labelNames, v.labelValues, float64(v.count))
+	}
+}
+
+// metricSample is a sample of a metricFunc
+type metricSample struct {
+	labelValues []string
+	value       float64
+}
+
+// metricFunc is a metric whose samples are taken at each scrape, from the stats of a component
+type metricFunc struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	collect    func() []metricSample
+}
+
+func newMetricFunc(name string, help string, metricType string, labelNames []string, collect func() []metricSample) *metricFunc {
+	m := &metricFunc{name: name, help: help, metricType: metricType, labelNames: labelNames, collect: collect}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+func (m *metricFunc) write(w io.Writer) {
+	writeMetricHeader(w, m.name, m.help, m.metricType)
+	for _, sample := range m.collect() {
+		writeSample(w, m.name, m.labelNames, sample.labelValues, sample.value)
+	}
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetricHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, metricType)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w io.Writer, name string, labelNames []string, labelValues []string, value float64) {
+	labels := make([]string, len(labelNames))
+	for i, labelName := range labelNames {
+		labels[i] = labelName + `="` + labelValueEscaper.Replace(labelValues[i]) + `"`
+	}
+	if len(labels) > 0 {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(labels, ","), formatFloat(value))
+	} else {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+	}
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// The metrics of the requests
+var (
+	requestsTotal = newCounterVec("web3url_requests_total",
+		"Requests served, by chain, resolve mode, name service and status code",
+		"chain", "resolve_mode", "ns", "code")
+	requestDuration = newHistogramVec("web3url_request_duration_seconds",
+		"Duration of the requests, by chain, resolve mode, name service and status code",
+		defaultLatencyBuckets, "chain", "resolve_mode", "ns", "code")
+	responseBytes = newCounterVec("web3url_response_bytes_total",
+		"Bytes of the response bodies served, by chain and name service",
+		"chain", "ns")
+)
+
+// observeRequest records the metrics of a request, once served
+func observeRequest(info *requestInfo, code int, bytes int64, duration time.Duration) {
+	requestsTotal.inc(info.chain, info.resolveMode, info.nsType, strconv.Itoa(code))
+	requestDuration.observe(duration.Seconds(), info.chain, info.resolveMode, info.nsType, strconv.Itoa(code))
+	responseBytes.add(float64(bytes), info.chain, info.nsType)
+}
+
+// The metrics of the backends
+var (
+	rpcDuration = newHistogramVec("web3url_rpc_request_duration_seconds",
+		"Duration of the requests to the RPC endpoints, by chain and endpoint",
+		defaultLatencyBuckets, "chain", "endpoint")
+	rpcErrors = newCounterVec("web3url_rpc_errors_total",
+		"Failed requests to the RPC endpoints (network errors, timeouts, HTTP 5xx and 429), by chain and endpoint",
+		"chain", "endpoint")
+	ordinalsDuration = newHistogramVec("web3url_ordinals_request_duration_seconds",
+		"Duration of the requests to the ordinals backend, by result",
+		defaultLatencyBuckets, "result")
+	certificatesStored = newCounterVec("web3url_certificates_stored_total",
+		"Certificates issued by ACME and stored, by result",
+		"result")
+	certificateErrors = newCounterVec("web3url_certificate_errors_total",
+		"TLS handshakes without certificate for the requested host")
+)
+
+// The metrics of the components with their own stats
+var (
+	_ = newMetricFunc("web3url_response_cache_requests_total",
+		"Lookups in the response cache, by result", "counter", []string{"result"},
+		func() []metricSample {
+			if responses == nil {
+				return nil
+			}
+			stats := responses.getStats()
+			return []metricSample{
+				{[]string{"hit"}, float64(stats.Hits)},
+				{[]string{"miss"}, float64(stats.Misses)},
+				{[]string{"bypass"}, float64(stats.Bypasses)},
+			}
+		})
+	_ = newMetricFunc("web3url_cname_cache_requests_total",
+		"Lookups in the CNAME cache, by result", "counter", []string{"result"},
+		func() []metricSample {
+			stats := getCnameCache().getStats()
+			return []metricSample{
+				{[]string{"hit"}, float64(stats.Hits)},
+				{[]string{"negative_hit"}, float64(stats.NegativeHits)},
+				{[]string{"miss"}, float64(stats.Misses)},
+				{[]string{"collapsed"}, float64(stats.Collapsed)},
+			}
+		})
+	_ = newMetricFunc("web3url_rpc_throttled_total",
+		"Requests over the RPC budget of a chain", "counter", []string{"chain"},
+		func() []metricSample {
+			samples := []metricSample{}
+			for _, chainId := range sortedRPCChains() {
+				if stats := rpcPools[chainId].limiter.getStats(); stats != nil {
+					samples = append(samples, metricSample{[]string{strconv.Itoa(chainId)}, float64(stats.Throttled)})
+				}
+			}
+			return samples
+		})
+	_ = newMetricFunc("web3url_rpc_endpoint_up",
+		"Whether an RPC endpoint can be used: healthy, not quarantined and not left aside after failures",
+		"gauge", []string{"chain", "endpoint"},
+		func() []metricSample {
+			samples := []metricSample{}
+			for _, chainId := range sortedRPCChains() {
+				pool := rpcPools[chainId]
+				now := pool.now()
+				for _, endpoint := range pool.endpoints {
+					up := 0.0
+					if endpoint.available(now) {
+						up = 1
+					}
+					samples = append(samples, metricSample{[]string{strconv.Itoa(chainId), redactRPCURL(endpoint.URL)}, up})
+				}
+			}
+			return samples
+		})
+	_ = newMetricFunc("web3url_client_throttled_total",
+		"Requests over the rate limit of their client", "counter", nil,
+		func() []metricSample {
+			if clientLimits == nil {
+				return nil
+			}
+			return []metricSample{{nil, float64(clientLimits.getStats().Throttled)}}
+		})
+)
+
+// sortedRPCChains returns the chains with an RPC pool, sorted
+func sortedRPCChains() []int {
+	chains := make([]int, 0, len(rpcPools))
+	for chainId := range rpcPools {
+		chains = append(chains, chainId)
+	}
+	sort.Ints(chains)
+	return chains
+}
+
+// handleMetrics serves the metrics in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buffered := bufio.NewWriter(w)
+	for _, m := range metricsRegistry {
+		m.write(buffered)
+	}
+	if err := buffered.Flush(); err != nil {
+		log.Errorf("Cannot write metrics: %v\n", err)
+	}
+}
+
+// defaultMetricsAddr keeps the metrics private, unless MetricsAddr says otherwise
+const defaultMetricsAddr = "127.0.0.1:9100"
+
+// adminMux serves the metrics and the other internal endpoints, apart from the gateway
+var adminMux = http.NewServeMux()
+
+// initMetrics serves the metrics at /metrics, with the other handlers of adminMux, on their own
+// address: MetricsAddr, by default on localhost only
+func initMetrics() {
+	adminMux.HandleFunc("/metrics", handleMetrics)
+	addr := stringOr(config.MetricsAddr, defaultMetricsAddr)
+	log.Infof("Serving metrics on http://%v/metrics\n", addr)
+	server := setServerTimeouts(&http.Server{Addr: addr, Handler: adminMux})
+	serve(server, server.ListenAndServe)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	counter := &counterVec{name: "test_total", help: "Test counter", labelNames: []string{"chain", "code"}, values: map[string]*counterValue{}}
+	counter.inc("1", "200")
+	counter.add(2, "1", "200")
+	counter.inc("5", `"404"`)
+	w := &strings.Builder{}
+	counter.write(w)
+	assert.Equal(t, `# HELP test_total Test counter
+# TYPE test_total counter
+test_total{chain="1",code="200"} 3
+test_total{chain="5",code="\"404\""} 1
+`, w.String())
+
+	histogram := &histogramVec{name: "test_seconds", help: "Test histogram", labelNames: []string{"chain"}, buckets: []float64{0.1, 1}, values: map[string]*histogramValue{}}
+	histogram.observe(0.05, "1")
+	histogram.observe(0.1, "1")
+	histogram.observe(0.5, "1")
+	histogram.observe(3, "1")
+	w = &strings.Builder{}
+	histogram.write(w)
+	assert.Equal(t, `# HELP test_seconds Test histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{chain="1",le="0.1"} 2
+test_seconds_bucket{chain="1",le="1"} 3
+test_seconds_bucket{chain="1",le="+Inf"} 4
+test_seconds_sum{chain="1"} 3.65
+test_seconds_count{chain="1"} 4
+`, w.String())
+}
+
+func TestInstrument(t *testing.T) {
+	handler := instrument(func(w http.ResponseWriter, req *http.Request) {
+		info := getRequestInfo(req)
+		info.chain, info.resolveMode, info.nsType = "11155111", "manual", "ens"
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("not found"))
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, `web3url_requests_total{chain="11155111",resolve_mode="manual",ns="ens",code="404"} 2`)
+	assert.Contains(t, body, `web3url_request_duration_seconds_count{chain="11155111",resolve_mode="manual",ns="ens",code="404"} 2`)
+	assert.Contains(t, body, `web3url_response_bytes_total{chain="11155111",ns="ens"} 18`)
+	assert.Contains(t, body, "# TYPE web3url_rpc_request_duration_seconds histogram")
+
+	// Not instrumented
+	getRequestInfo(httptest.NewRequest("GET", "/", nil)).chain = "1"
+}
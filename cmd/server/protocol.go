@@ -1,16 +1,13 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
-	"bytes"
-	"compress/gzip"
-	"io/ioutil"
 
 	log "github.com/sirupsen/logrus"
 
@@ -20,33 +17,72 @@ import (
 )
 
 func handle(w http.ResponseWriter, req *http.Request) {
+	if !checkClientRateLimit(w, req) {
+		return
+	}
+	// Deadline of the name resolutions and of the fetch of the response
+	ctx, cancel := context.WithTimeout(req.Context(), requestTimeout())
+	defer cancel()
+	req = req.WithContext(ctx)
 
 	h := req.Host
 
-	if cname, err := net.LookupCNAME(h); err == nil {
-		log.Infof("cname is ---> %s", cname)
-		if strings.HasSuffix(cname, ".") {
-			h = cname[:len(cname)-1]
-			w.Header().Set("Web3-CNAME", cname)
-		}
+	// Custom domain: from the config, or with a web3:// URL in its _web3 TXT record
+	ctx, span := startSpan(req.Context(), "lookupCustomDomain", spanKindInternal)
+	site, err := lookupCustomDomain(ctx, h)
+	span.fail(err)
+	span.finish()
+	if err != nil {
+		// A DNS failure must not take down the gateway hosts: the host goes through the host routes
+		log.Warnf("Cannot look up the custom domain %v: %v\n", h, err)
+	}
+	policy := newSitePolicy(site)
+
+	if site == nil {
+		ctx, span := startSpan(req.Context(), "lookupCname", spanKindInternal)
+		cname := lookupCname(ctx, h)
+		span.set("dns.cname", cname)
+		span.finish()
+		if cname != "" {
+			log.Debugf("cname is ---> %s", cname)
+			if strings.HasSuffix(cname, ".") {
+				h = cnameHost(h, cname[:len(cname)-1])
+				w.Header().Set("Web3-CNAME", cname)
+			}
 
+		}
 	}
 
 	path := req.URL.EscapedPath()
-	w.Header().Set("Access-Control-Allow-Origin", config.CORS)
-	if strings.HasPrefix(h, "ordinals.btc.") {
+	policy.cors.setHeaders(w.Header(), req)
+	// CORS preflights are answered without fetching anything
+	if req.Method == http.MethodOptions {
+		handleOptions(w, req)
+		return
+	}
+	if site == nil && strings.HasPrefix(h, "ordinals.btc.") {
 		handleOrdinals(w, req, path)
 		return
 	}
 
 	// Convert the subdomain and path to a web3:// URL (without "web3:/" prefix and the query)
-	p, _, er := handleSubdomain(h, path)
+	var p string
+	var er error
+	_, span = startSpan(req.Context(), "route", spanKindInternal)
+	if site != nil {
+		w.Header().Set("Web3-Custom-Domain-Root", site.Root)
+		p, er = customDomainPath(site.Root, path)
+	} else {
+		p, _, er = handleSubdomain(h, path)
+	}
+	span.fail(er)
+	span.finish()
 	if er != nil {
-		respondWithErrorPage(w, &web3protocol.ErrorWithHttpCode{http.StatusBadRequest, er.Error()})
+		respondWithErrorPage(w, &web3protocol.ErrorWithHttpCode{HttpCode: http.StatusBadRequest, Err: er.Error()})
 		return
 	}
-	if p == "/" {
-		http.Redirect(w, req, config.HomePage, http.StatusFound)
+	if p == "/" || site != nil && path == "/" && site.HomePage != "" {
+		http.Redirect(w, req, policy.homePage, http.StatusFound)
 		return
 	}
 
@@ -56,18 +92,49 @@ func handle(w http.ResponseWriter, req *http.Request) {
 		web3Url += "?" + req.URL.RawQuery
 	}
 
-	log.Infof("web3url : %s", web3Url)
+	log.Debugf("web3url : %s", web3Url)
+	info := getRequestInfo(req)
+	info.web3Url = web3Url
 
 	// Fetch the web3 URL
-	fetchedWeb3Url, err := web3protocolClient.FetchUrl(web3Url)
+	ctx, span = startSpan(req.Context(), "fetchWeb3Response", spanKindInternal)
+	span.set("web3.url", web3Url)
+	resp, err := fetchWeb3Response(web3Url, req.WithContext(ctx))
+	span.fail(err)
 	if err != nil {
-		respondWithErrorPage(w, err)
+		span.finish()
+		respondWithErrorPage(w, asTimeout(req.Context(), err, web3Url))
 		return
 	}
+	// The body is replaced by its buffered reader when it is read ahead
+	defer func() { _ = resp.body.Close() }()
+	info.chain, info.resolveMode, info.nsType = strconv.Itoa(resp.chainId), resp.header.Get("Web3-Resolve-Mode"), resp.nsType
+	info.contract, info.cacheStatus = resp.header.Get("Web3-Contract-Address"), resp.cacheStatus
+	span.set("web3.chain", info.chain)
+	span.set("web3.contract", info.contract)
+	span.set("web3.resolve_mode", info.resolveMode)
+	span.set("cache.status", info.cacheStatus)
+	span.finish()
+	// Give an ETag to the responses without one, for the conditional requests. HEAD requests
+	// do not read the body, so they only get the ETag of the contract or of the response cache.
+	if req.Method != http.MethodHead {
+		err = addETag(resp, config.ETagMaxBodyBytes, req.Header.Get("If-None-Match") != "")
+		if err != nil {
+			respondWithErrorPage(w, &web3protocol.ErrorWithHttpCode{HttpCode: http.StatusBadRequest, Err: err.Error()})
+			return
+		}
+	}
 
-	// Send the HTTP headers returned by the protocol
-	for httpHeaderName, httpHeaderValue := range fetchedWeb3Url.HttpHeaders {
-		w.Header().Set(httpHeaderName, httpHeaderValue)
+	// Send the HTTP headers returned by the protocol, and the debug headers
+	for httpHeaderName, httpHeaderValues := range resp.header {
+		if httpHeaderName == "Vary" {
+			// Keep the Vary: Origin of the CORS policy
+			for _, httpHeaderValue := range httpHeaderValues {
+				w.Header().Add(httpHeaderName, httpHeaderValue)
+			}
+			continue
+		}
+		w.Header()[httpHeaderName] = httpHeaderValues
 	}
 	// Golang HTTP server has a weird default : if we don't explicitely add a content-type header,
 	// it will add his own Content-Type: text/xml; charset=utf-8
@@ -76,99 +143,140 @@ func handle(w http.ResponseWriter, req *http.Request) {
 		// only set it to empty. This code looks weird but it works.
 		w.Header().Set("Content-Type", "")
 	}
+	if policy.cacheControl != "" {
+		w.Header().Set("Cache-Control", policy.cacheControl)
+	}
+	if resp.cacheStatus != "" {
+		w.Header().Set("Web3-Cache-Status", resp.cacheStatus)
+	}
 
-	// Add some debug headers
-	parsedWeb3Url := fetchedWeb3Url.ParsedUrl
-	if parsedWeb3Url.HostDomainNameResolver != "" {
-		w.Header().Set("Web3-Host-Domain-Name-Resolver", string(parsedWeb3Url.HostDomainNameResolver))
-		w.Header().Set("Web3-Host-Domain-Name-Resolver-Chain", fmt.Sprintf("%d", parsedWeb3Url.HostDomainNameResolverChainId))
-	}
-	w.Header().Set("Web3-Contract-Address", parsedWeb3Url.ContractAddress.String())
-	w.Header().Set("Web3-Chain-Id", fmt.Sprintf("%d", parsedWeb3Url.ChainId))
-	w.Header().Set("Web3-Resolve-Mode", string(parsedWeb3Url.ResolveMode))
-	w.Header().Set("Web3-Contract-Call-Mode", string(parsedWeb3Url.ContractCallMode))
-	calldata, _ := parsedWeb3Url.ComputeCalldata()
-	w.Header().Set("Web3-Calldata", fmt.Sprintf("0x%x", calldata))
-	if parsedWeb3Url.ContractCallMode == web3protocol.ContractCallModeMethod {
-		w.Header().Set("Web3-Mode-Auto-Method", parsedWeb3Url.MethodName)
-		methodArgTypes := []string{}
-		for _, methodArgType := range parsedWeb3Url.MethodArgs {
-			methodArgTypes = append(methodArgTypes, methodArgType.String())
+	// If the content type is text/html, we do some processing on the data
+	// - patching the fetch() JS function so that it works with web3:// URLs
+	// - Handling <a> links to absolute web3:// URLs
+	// The size of the body changes, so the Content-Length header (if any) is no longer valid
+	patchHTML := policy.patchHTML && isHTMLContentType(w.Header().Get("Content-Type")) && isSupportedContentEncoding(w.Header().Get("Content-Encoding"))
+	// The gateway URL the web3:// links of the page are rewritten to, if they are
+	scheme, gatewayHost := "", ""
+	if patchHTML && config.RewriteWeb3Links {
+		scheme, gatewayHost = requestScheme(req), gatewayBaseHost(h)
+		// Custom domains do not serve the gateway host layouts
+		if site != nil && len(config.GatewayDomains) > 0 {
+			gatewayHost = config.GatewayDomains[0]
 		}
-		w.Header().Set("Web3-Mode-Auto-Method-Arg-Types", strings.Join(methodArgTypes, ","))
-		formattedMethodArgValues := make([]interface{}, 0)
-		for i, methodArgValue := range parsedWeb3Url.MethodArgValues {
-			formattedValue, err := web3protocol.JsonEncodeAbiTypeValue(parsedWeb3Url.MethodArgs[i], methodArgValue)
-			if err != nil {
-				respondWithErrorPage(w, err)
-				return
+	}
+	if patchHTML {
+		w.Header().Del("Content-Length")
+		if etag := w.Header().Get("ETag"); etag != "" {
+			linkBase := ""
+			if gatewayHost != "" {
+				linkBase = scheme + "://" + gatewayHost
 			}
-			formattedMethodArgValues = append(formattedMethodArgValues, formattedValue)
-		}
-		jsonEncodedMethodArgValues, err := json.Marshal(formattedMethodArgValues)
-		if err != nil {
-			respondWithErrorPage(w, err)
-			return
-		}
-		w.Header().Set("Web3-Mode-Auto-Method-Arg-Values", string(jsonEncodedMethodArgValues))
-	}
-	w.Header().Set("Web3-Contract-Return-Processing", string(parsedWeb3Url.ContractReturnProcessing))
-	if parsedWeb3Url.ContractReturnProcessing == web3protocol.ContractReturnProcessingDecodeABIEncodedBytes {
-		w.Header().Set("Web3-Decoded-ABI-Encoded-Bytes-Mime-Type", parsedWeb3Url.DecodedABIEncodedBytesMimeType)
-	} else if parsedWeb3Url.ContractReturnProcessing == web3protocol.ContractReturnProcessingJsonEncodeValues {
-		valueTypes := []string{}
-		for _, valueType := range parsedWeb3Url.JsonEncodedValueTypes {
-			valueTypes = append(valueTypes, valueType.String())
+			w.Header().Set("ETag", patchedETag(etag, linkBase))
 		}
-		w.Header().Set("Web3-Json-Encoded-Value-Types", strings.Join(valueTypes, ","))
 	}
 
-	// Send the HTTP code
-	w.WriteHeader(fetchedWeb3Url.HttpCode)
+	// The client already has this version of the resource
+	if resp.httpCode == http.StatusOK && isNotModified(req, w.Header()) {
+		writeNotModified(w)
+		return
+	}
 
 	// Send the output
-	// We receive it chunk by chunk from web3protocol-go. Usually there is only a single chunk.
-	outputDataLength := 0
-	buf := make([]byte, 8*1024*1024)
-	for {
-		// Fetch data from web3protocol-go
-		n, err := fetchedWeb3Url.Output.Read(buf)
-		if err != nil && err != io.EOF {
-			respondWithErrorPage(w, &web3protocol.ErrorWithHttpCode{http.StatusBadRequest, err.Error()})
-			return
+	// We receive it chunk by chunk from web3protocol-go, and flush each of them so that it
+	// gets sent right away, as a chunk
+	output := &countingWriter{w: flushWriter{w}}
+
+	// Range requests, on the resources which are not patched
+	servedRanges := false
+	if resp.httpCode == http.StatusOK && !patchHTML {
+		w.Header().Set("Accept-Ranges", "bytes")
+		servedRanges, err = serveRanges(w, req, resp, output)
+	}
+	headersSent := servedRanges
+
+	if !servedRanges && err == nil {
+		// Send the HTTP code
+		w.WriteHeader(resp.httpCode)
+		headersSent = true
+
+		switch {
+		case req.Method == http.MethodHead:
+			// Same headers as GET, but the body is not read, so that its next chunks are not
+			// fetched from the contract
+		case patchHTML:
+			// Optionally, convert the web3:// links of the page into gateway links, for browsers
+			// without javascript, and for resources the injected script cannot patch (<img>, CSS, ...)
+			var rewriteLink func(string) string
+			if config.RewriteWeb3Links {
+				rewriteLink = func(link string) string {
+					gatewayUrl, err := web3UrlToGatewayUrl(link, scheme, gatewayHost)
+					if err != nil {
+						return link
+					}
+					return gatewayUrl
+				}
+			}
+			_, span = startSpan(req.Context(), "rewriteHTML", spanKindInternal)
+			err = rewriteHTML(output, resp.body, w.Header().Get("Content-Encoding"), rewriteLink)
+			span.fail(err)
+			span.finish()
+		default:
+			_, err = io.Copy(output, resp.body)
 		}
-		if n == 0 {
-			break
+	}
+	if err != nil {
+		if headersSent {
+			// Too late for an error page: the response is cut short, so that the client does
+			// not take it as complete
+			log.Infof("Cannot send the response of %v: %v\n", web3Url, err)
+			panic(http.ErrAbortHandler)
 		}
+		respondWithErrorPage(w, &web3protocol.ErrorWithHttpCode{HttpCode: http.StatusBadRequest, Err: err.Error()})
+		return
+	}
+	outputDataLength := output.n
 
-		// If the content type is text/html, we do some processing on the data
-		// - patching the fetch() JS function so that it works with web3:// URLs
-		// - Handling <a> links to absolute web3:// URLs
-		if w.Header().Get("Content-Type") == "text/html" {
-			n = patchHTMLFile(buf, n, w.Header().Get("Content-Encoding"))
-		}
+	// Stats
+	stats(outputDataLength, clientIP(req), fmt.Sprintf("%d", resp.chainId), resp.nsType, path, h)
+}
 
-		// Update the total output data length
-		outputDataLength += n
+// requestScheme returns the scheme used by the client to reach the gateway. X-Forwarded-Proto
+// is only honored from trusted proxies: the links of the rewritten pages (and their ETags) would
+// otherwise be chosen by any client.
+func requestScheme(req *http.Request) string {
+	if proto := req.Header.Get("X-Forwarded-Proto"); (proto == "http" || proto == "https") && fromTrustedProxy(req) {
+		return proto
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
 
-		// Feed the data to the HTTP client
-		_, err = w.Write(buf[:n])
-		if err != nil {
-			respondWithErrorPage(w, &web3protocol.ErrorWithHttpCode{http.StatusBadRequest, err.Error()})
-			return
-		}
+// flushWriter flushes the underlying ResponseWriter after each write
+// (This is still an HTTP 1.1 server, so it's using Transfer-encoding: chunked)
+type flushWriter struct {
+	w http.ResponseWriter
+}
 
-		// Flush it so that it gets sent right away, as a chunk
-		// (This is still an HTTP 1.1 server, so it's using Transfer-encoding: chunked)
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
-		}
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
 	}
+	return n, err
+}
 
-	// Stats
-	if len(*dbToken) > 0 {
-		stats(outputDataLength, req.RemoteAddr, fmt.Sprintf("%d", parsedWeb3Url.ChainId), fmt.Sprintf("%v", parsedWeb3Url.HostDomainNameResolver), path, h)
-	}
+// countingWriter counts the number of bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
 }
 
 func respondWithErrorPage(w http.ResponseWriter, err error) {
@@ -176,6 +284,11 @@ func respondWithErrorPage(w http.ResponseWriter, err error) {
 	switch err.(type) {
 	case *web3protocol.ErrorWithHttpCode:
 		httpCode = err.(*web3protocol.ErrorWithHttpCode).HttpCode
+	case *rpcThrottledError:
+		httpCode = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", err.(*rpcThrottledError).retryAfterSeconds())
+	case *upstreamTimeoutError:
+		httpCode = http.StatusGatewayTimeout
 	}
 
 	w.WriteHeader(httpCode)
@@ -186,12 +299,12 @@ func respondWithErrorPage(w http.ResponseWriter, err error) {
 	}
 }
 
-// process request with contract info in subdomain:
+// process request with contract info in subdomain (see HostRoute):
 // e.g.,
 // 0xe9e7cea3dedca5984780bafc599bd69add087d56.w3bnb.io
 // quark.w3q.w3q-g.w3link.io
 func handleSubdomain(host string, path string) (p string, useSubdomain bool, err error) {
-	log.Info(host + path)
+	log.Debug(host + path)
 
 	// Remove port from end of host
 	if strings.Index(host, ":") > 0 {
@@ -202,12 +315,7 @@ func handleSubdomain(host string, path string) (p string, useSubdomain bool, err
 		return "", false, fmt.Errorf("invalid subdomain")
 	}
 
-	hostParts := strings.Split(host, ".")
-	hostPartsCount := len(hostParts)
-	if hostPartsCount > 6 {
-		log.Info("subdomain too long")
-		return "", false, fmt.Errorf("invalid subdomain")
-	}
+	subdomainParts, _ := splitGatewayHost(host)
 
 	p = path
 
@@ -216,7 +324,7 @@ func handleSubdomain(host string, path string) (p string, useSubdomain bool, err
 	// https://localhost/quark.w3q/index.txt -> web3://quark.w3q/index.txt
 	// https://w3eth.io/quark.w3q/index.txt -> web3://quark.w3q/index.txt
 	// https://w3bnb.io/0x90560AD4A95147a00Ef17A3cC48b4Ef337a5E699/index.txt (with defaultChain = 56) -> web3://0x90560AD4A95147a00Ef17A3cC48b4Ef337a5E699:56/index.txt
-	if hostPartsCount <= 2 {
+	if len(subdomainParts) == 0 {
 		pathParts := strings.Split(p, "/")
 		// If no chain id, and we have a defaultChain : set it
 		if len(strings.Split(pathParts[1], ":")) == 1 && config.DefaultChain > 1 {
@@ -230,245 +338,63 @@ func handleSubdomain(host string, path string) (p string, useSubdomain bool, err
 		if strings.HasSuffix(strings.Split(p, "/")[1], ".w3q") {
 			p = strings.Replace(p, ".w3q/", ".w3q:3334/", 1)
 		}
+
+		log.Debug("=>", p)
+		return p, false, nil
 	}
 
-	// https://[web3-hex-address | web3-host-name].[gateway-host].[gateway-tld]
-	// These URLs require a default chain specified in config. Examples, with default chain id == 1:
-	// https://quark.w3eth.io/index.txt -> web3://quark.eth/index.txt ("eth" deduced as
-	//   the default domain name service TLD from config)
+	// https://[subdomain].[gateway-domain], with the subdomain matched against the host routes
+	// (see HostRoute). Examples, with the default routes:
+	// https://quark.w3eth.io/index.txt -> web3://quark.eth/index.txt (with default chain id == 1,
+	//   "eth" deduced as the default domain name service TLD from config)
 	// https://0x90560AD4A95147a00Ef17A3cC48b4Ef337a5E699.w3eth.io/index.txt ->
-	//   web3://0x90560AD4A95147a00Ef17A3cC48b4Ef337a5E699:1/index.txt
-	if hostPartsCount == 3 {
-		if config.DefaultChain == 0 {
-			return "", false, fmt.Errorf("default chain is not specified")
+	//   web3://0x90560AD4A95147a00Ef17A3cC48b4Ef337a5E699:1/index.txt (with default chain id == 1)
+	// https://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.sep.w3link.io/index.txt -> web3://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:11155111/index.txt
+	// https://quark.w3q.w3q-g.w3link.io/index.txt -> web3://quark.w3q:3334/index.txt
+	// https://dblog.dblog.eth.11155111.w3link.io/ -> web3://dblog.dblog.eth:11155111/
+	var name, chain string
+	var route HostRoute
+	matched := false
+	for _, route = range hostRoutes() {
+		name, chain, matched, err = route.match(subdomainParts)
+		if err != nil {
+			log.Info(err.Error())
+			return "", false, err
 		}
-		if common.IsHexAddress(hostParts[0]) {
-			//e.g. 0xe9e7cea3dedca5984780bafc599bd69add087d56.w3bnb.io/name?returns=(string)
-			p = "/" + hostParts[0] + ":" + strconv.Itoa(config.DefaultChain) + path
-		} else {
-			//e.g. quark.w3eth.io
-			suffix, err := getDefaultNSSuffix()
-			if err != nil {
-				log.Info(err.Error())
-				return "", false, fmt.Errorf("invalid subdomain")
-			}
-			name := hostParts[0] + "." + suffix
-
-			// back compatible with hosted dweb files
-			if !strings.Contains(path, "/"+name+"/") {
-				p = "/" + name + path
-			}
+		if matched {
+			break
 		}
-		useSubdomain = true
+	}
+	if !matched {
+		log.Info("no host route matches the subdomain")
+		return "", false, fmt.Errorf("invalid subdomain")
 	}
 
-	// https://[web3-hex-address].[web3-chain-id | web3-chain-shortname].[gateway-host].[gateway-tld]
-	// Examples:
-	// https://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.11155111.w3link.io/index.txt -> web3://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:11155111/index.txt
-	// https://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.sep.w3link.io/index.txt -> web3://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:11155111/index.txt
-	if hostPartsCount == 4 {
-		if !common.IsHexAddress(hostParts[0]) {
-			log.Info("invalid contract address")
-			return "", false, fmt.Errorf("invalid subdomain")
-		}
-
-		// Hostname: If [host]:[chain-short-name] then [host]:[chain-id]
-		full := hostChangeChainShortNameToId(hostParts[0] + ":" + hostParts[1])
+	// Hostname: If [host]:[chain-short-name] then [host]:[chain-id]
+	full := name
+	if chain != "" {
+		full = hostChangeChainShortNameToId(name + ":" + chain)
+	}
 
+	if common.IsHexAddress(name) {
+		// back compatible with hosted dweb files, under the subdomains with a chain
 		pp := strings.Split(path, "/")
-		if strings.HasSuffix(pp[1], ".w3q") || strings.HasSuffix(pp[1], ".eth") {
+		if route.count(routeChain) > 0 && (strings.HasSuffix(pp[1], ".w3q") || strings.HasSuffix(pp[1], ".eth")) {
 			p = strings.Replace(path, pp[1], full, 1)
 		} else {
 			p = "/" + full + path
 		}
-		useSubdomain = true
-	}
-
-	// https://[web3-host-name].[web3-host-tld].[web3-chain-id | web3-chain-shortname].[gateway-host].[gateway-tld]
-	// Examples:
-	// https://quark.w3q.3334.w3link.io/index.txt -> web3://quark.w3q:3334/index.txt
-	// https://quark.w3q.w3q-g.w3link.io/index.txt -> web3://quark.w3q:3334/index.txt
-	if hostPartsCount == 5 {
-		if config.DefaultChain > 0 {
-			log.Info("no tld should be provided when default chain is specified")
-			return "", false, fmt.Errorf("invalid subdomain")
-		}
-
-		name := hostParts[0] + "." + hostParts[1]
-		// Hostname: If [host]:[chain-short-name] then [host]:[chain-id]
-		full := hostChangeChainShortNameToId(name + ":" + hostParts[2])
-
+	} else {
 		if strings.Index(path, "/"+name+"/") == 0 {
 			// append chain short name to hosted dweb files
 			p = strings.Replace(path, "/"+name+"/", "/"+full+"/", 1)
 		} else if !strings.Contains(path, "/"+name+"/") {
 			p = "/" + full + path
 		}
-		useSubdomain = true
 	}
+	useSubdomain = true
 
-	// https://[web3-host-subdomain].[web3-host-name].[web3-host-tld].[web3-chain-id | web3-chain-shortname].[gateway-host].[gateway-tld]
-	// Examples:
-	// https://dblog.dblog.eth.11155111.w3link.io/ -> web3://dblog.dblog.eth:11155111/
-	if hostPartsCount == 6 {
-		if config.DefaultChain > 0 {
-			log.Info("no tld should be provided when default chain is specified")
-			return "", false, fmt.Errorf("invalid subdomain")
-		}
-
-		name := hostParts[0] + "." + hostParts[1] + "." + hostParts[2]
-		// Hostname: If [host]:[chain-short-name] then [host]:[chain-id]
-		full := hostChangeChainShortNameToId(name + ":" + hostParts[3])
-
-		if strings.Index(path, "/"+name+"/") == 0 {
-			// append chain short name to hosted dweb files
-			p = strings.Replace(path, "/"+name+"/", "/"+full+"/", 1)
-		} else if !strings.Contains(path, "/"+name+"/") {
-			p = "/" + full + path
-		}
-		useSubdomain = true
-	}
-
-	log.Info("=>", p)
+	log.Debug("=>", p)
 
 	return p, useSubdomain, nil
 }
-
-// If the content type is text/html, we do some processing on the data
-// - patching the fetch() JS function so that it works with web3:// URLs
-// - Handling <a> links to absolute web3:// URLs
-// This is not 100% perfect:
-// - This will fail if the content is compressed and spread over several chunks (should be rare)
-func patchHTMLFile(buf []byte, n int, contentEncoding string) (int) {
-	// Create a new buffer of length n, and copy the data into it
-	alteredBuf := make([]byte, n)
-	copy(alteredBuf, buf[:n])
-	
-	// If contentEncoding is "gzip", then first decompress the data
-	if contentEncoding == "gzip" {
-		gzipReader, err := gzip.NewReader(bytes.NewReader(alteredBuf))
-		if err != nil {
-			log.Infof("patchHtmlFile: Cannot initiate gzip decompression: %v\n", err)
-			return n
-		}
-		alteredBuf, err = ioutil.ReadAll(gzipReader);
-		if err != nil {
-			log.Infof("patchHtmlFile: Cannot decompress gzip data (likely spread over several chunks): %v\n", err)
-			return n
-		}
-	}
-
-	// Look for the "<head>" tag, and insert the patch right after it
-	headTagIndex := strings.Index(string(alteredBuf), "<head>")
-	if headTagIndex == -1 {
-		return n
-	}
-	
-	// Insert the patch right after the "<head>" tag
-	patch := []byte(`
-		<script>
-			(function() {
-				// Web3:// URL to Gateway URL convertor
-				const convertWeb3UrlToGatewayUrl = function(web3Url) {
-					// Parse the URL
-					let matchResult = web3Url.match(/^(?<protocol>[^:]+):\/\/(?<hostname>[^:/?]+)(:(?<chainId>[1-9][0-9]*))?(?<path>.*)?$/)
-					if(matchResult == null) {
-						// Invalid web3:// URL
-						return null;
-					}
-					let urlMainParts = matchResult.groups
-			
-					// Check protocol name
-					if(["web3", "w3"].includes(urlMainParts.protocol) == false) {
-						// Bad protocol name"
-						return null;
-					}
-			
-					// Get subdomain components
-					let gateway = window.location.hostname.split('.').slice(-2).join('.') + (window.location.port ? ':' + window.location.port : '');
-					let subDomains = []
-					// Is the contract an ethereum address?
-					if(/^0x[0-9a-fA-F]{40}$/.test(urlMainParts.hostname)) {
-						subDomains.push(urlMainParts.hostname)
-						if(urlMainParts.chainId !== undefined) {
-							subDomains.push(urlMainParts.chainId)
-						}
-						else {
-							// gateway = "w3eth.io"
-							subDomains.push(1);
-						}
-					}
-					// It is a domain name
-					else {
-						// ENS domains on mainnet have a shortcut
-						if(urlMainParts.hostname.endsWith('.eth') && urlMainParts.chainId === undefined) {
-							// gateway = "w3eth.io"
-							// subDomains.push(urlMainParts.hostname.slice(0, -4))
-							subDomains.push(urlMainParts.hostname)
-							subDomains.push(1)
-						}
-						else {
-							subDomains.push(urlMainParts.hostname)
-							if(urlMainParts.chainId !== undefined) {
-								subDomains.push(urlMainParts.chainId)
-							}
-						}
-					}
-			
-					let gatewayUrl = window.location.protocol + "//" + subDomains.join(".") + "." + gateway + (urlMainParts.path ?? "")
-					return gatewayUrl;
-				}
-
-
-				// Wrap the fetch() function to convert web3:// URLs into gateway URLs
-				const originalFetch = fetch;
-				fetch = function(input, init) {
-					// Process absolute web3:// URLS: convert them into gateway HTTP RULS
-					if (typeof input === 'string' && input.startsWith('web3://')) {
-						const convertedUrl = convertWeb3UrlToGatewayUrl(input);
-						if(convertedUrl) {
-							console.log('Gateway fetch() wrapper: Converted ' + input + ' to ' + convertedUrl);
-							input = convertedUrl;
-						}
-					}
-
-					// Pipe through the original fetch function
-					return originalFetch(input, init);
-				};
-
-
-				// Listen for clicks on <a> tags, and convert web3:// URLs into gateway URLs
-				document.addEventListener('click', function(event) {
-					if(event.target.tagName === 'A' && event.target.href.startsWith('web3://')) {
-						event.preventDefault();
-						const convertedUrl = convertWeb3UrlToGatewayUrl(event.target.href);
-						if(convertedUrl == null) {
-							console.log("A tag click wrapper: Unable to convert web3:// URL: " + event.target.href);
-							return;
-						}
-						console.log('A tag click wrapper: Converted ' + event.target.href + ' to ' + convertedUrl);
-						window.location.href = convertedUrl;
-					}
-				});
-			})();
-		</script>
-	`)
-	alteredBuf = append(
-		alteredBuf[:headTagIndex+len("<head>")], 
-		append(patch, alteredBuf[headTagIndex+len("<head")+1:len(alteredBuf)]...)...)
-
-	// If contentEncoding is "gzip", then recompress the data
-	if contentEncoding == "gzip" {
-		var compressedBuf bytes.Buffer
-		gzipWriter := gzip.NewWriter(&compressedBuf)
-		gzipWriter.Write(alteredBuf)
-		gzipWriter.Close()
-		alteredBuf = compressedBuf.Bytes()
-	}
-
-	// Finally: copy the altered data back into the original buffer and update n
-	copy(buf, alteredBuf)
-	n = len(alteredBuf)
-
-	return n
-}
\ No newline at end of file
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Responses of unknown size at most this large are buffered to answer Range requests
+	defaultRangeMaxBufferBytes = 8 << 20
+	// Max number of responses buffered at once to answer Range requests. The other Range
+	// requests of responses of unknown size are answered with the whole response.
+	rangeMaxConcurrentBuffers = 16
+)
+
+// rangeBuffers holds a slot for each response buffered to answer a Range request
+var rangeBuffers = make(chan struct{}, rangeMaxConcurrentBuffers)
+
+var (
+	errInvalidRange       = errors.New("invalid range")
+	errUnsatisfiableRange = errors.New("unsatisfiable range")
+)
+
+// httpRange is a range of bytes of a body
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header (RFC 9110, section 14.1.2) against the size of a body.
+// Ranges beyond the body are ignored, and errUnsatisfiableRange is returned if none remains.
+// e.g. with size == 1000:
+// bytes=0-499 -> [0, 500)
+// bytes=900- -> [900, 1000)
+// bytes=-100 -> [900, 1000)
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errInvalidRange
+	}
+	var ranges []httpRange
+	unsatisfiable := false
+	for _, spec := range strings.Split(s[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		var r httpRange
+		if first == "" {
+			// Suffix range: the last bytes of the body
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 {
+				unsatisfiable = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = httpRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			if start >= size {
+				unsatisfiable = true
+				continue
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			r = httpRange{start: start, length: end - start + 1}
+		}
+		if r.length > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	if len(ranges) == 0 {
+		if unsatisfiable || size == 0 {
+			return nil, errUnsatisfiableRange
+		}
+		return nil, errInvalidRange
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches tells if the If-Range precondition of a request (if any) holds for the headers
+// of the response: its strong ETag, or its exact Last-Modified date
+func ifRangeMatches(req *http.Request, header http.Header) bool {
+	ifRange := req.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := header.Get("ETag")
+		return !strings.HasPrefix(ifRange, "W/") && !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+	ifRangeDate, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && lastModified.Equal(ifRangeDate)
+}
+
+// bodySize returns the size of the body of a response, or -1 if it is unknown
+func bodySize(resp *web3Response) int64 {
+	if seeker, ok := resp.body.(io.Seeker); ok {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err == nil {
+			if _, err = seeker.Seek(0, io.SeekStart); err == nil {
+				return size
+			}
+		}
+	}
+	if size, err := strconv.ParseInt(resp.header.Get("Content-Length"), 10, 64); err == nil && size >= 0 {
+		return size
+	}
+	return -1
+}
+
+// serveRanges answers a Range request for a 200 response, and tells if it did. When it did not,
+// the caller sends the whole response.
+// Only the bytes up to the end of the last range are read from the body, so that the chunks
+// after it are not fetched from the contract.
+func serveRanges(w http.ResponseWriter, req *http.Request, resp *web3Response, output io.Writer) (bool, error) {
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader == "" || req.Method != http.MethodGet || !ifRangeMatches(req, w.Header()) {
+		return false, nil
+	}
+
+	size := bodySize(resp)
+	if size < 0 {
+		// Unknown size: buffer the body if it is small enough, and if a buffer slot is free
+		select {
+		case rangeBuffers <- struct{}{}:
+		default:
+			return false, nil
+		}
+		// The slot is released once the buffer is no longer used, when the body is closed
+		closer := &releasingCloser{Closer: resp.body, release: func() { <-rangeBuffers }}
+		maxBytes := config.RangeMaxBufferBytes
+		if maxBytes <= 0 {
+			maxBytes = defaultRangeMaxBufferBytes
+		}
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, io.LimitReader(resp.body, maxBytes+1))
+		if err != nil {
+			closer.once.Do(closer.release)
+			return false, err
+		}
+		if n > maxBytes {
+			// Too large: the whole body is streamed, without holding the slot
+			closer.once.Do(closer.release)
+			resp.body = readCloser{io.MultiReader(&buf, resp.body), resp.body}
+			return false, nil
+		}
+		resp.body = readSeekCloser{bytes.NewReader(buf.Bytes()), closer}
+		size = n
+	}
+
+	ranges, err := parseRange(rangeHeader, size)
+	if err == errUnsatisfiableRange {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Encoding")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return true, nil
+	}
+	if err != nil {
+		// Invalid Range headers are ignored
+		return false, nil
+	}
+	seeker, seekable := resp.body.(io.Seeker)
+	if !seekable {
+		// The body can only be read forward
+		for i := 1; i < len(ranges); i++ {
+			if ranges[i].start < ranges[i-1].start+ranges[i-1].length {
+				return false, nil
+			}
+		}
+	}
+	offset := int64(0)
+	copyRange := func(dst io.Writer, r httpRange) error {
+		if seekable {
+			if _, err := seeker.Seek(r.start, io.SeekStart); err != nil {
+				return err
+			}
+		} else if _, err := io.CopyN(io.Discard, resp.body, r.start-offset); err != nil {
+			return err
+		}
+		_, err := io.CopyN(dst, resp.body, r.length)
+		offset = r.start + r.length
+		return err
+	}
+
+	if len(ranges) == 1 {
+		w.Header().Set("Content-Range", ranges[0].contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		return true, copyRange(output, ranges[0])
+	}
+
+	// Multiple ranges: a multipart/byteranges body
+	contentType := w.Header().Get("Content-Type")
+	parts := multipart.NewWriter(output)
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+parts.Boundary())
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusPartialContent)
+	for _, r := range ranges {
+		partHeader := textproto.MIMEHeader{}
+		if contentType != "" {
+			partHeader.Set("Content-Type", contentType)
+		}
+		partHeader.Set("Content-Range", r.contentRange(size))
+		part, err := parts.CreatePart(partHeader)
+		if err != nil {
+			return true, err
+		}
+		if err := copyRange(part, r); err != nil {
+			return true, err
+		}
+	}
+	return true, parts.Close()
+}
+
+// releasingCloser closes a closer, and calls release the first time it is closed
+type releasingCloser struct {
+	io.Closer
+	release func()
+	once    sync.Once
+}
+
+func (c *releasingCloser) Close() error {
+	c.once.Do(c.release)
+	return c.Closer.Close()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		expect []httpRange
+		err    error
+	}{
+		{"bytes=0-499", []httpRange{{0, 500}}, nil},
+		{"bytes=900-", []httpRange{{900, 100}}, nil},
+		{"bytes=-100", []httpRange{{900, 100}}, nil},
+		{"bytes=-2000", []httpRange{{0, 1000}}, nil},
+		{"bytes=990-2000", []httpRange{{990, 10}}, nil},
+		{"bytes=0-0, 10-19", []httpRange{{0, 1}, {10, 10}}, nil},
+		{"bytes=0-9, 1000-", []httpRange{{0, 10}}, nil},
+		{"bytes=1000-", nil, errUnsatisfiableRange},
+		{"bytes=-0", nil, errUnsatisfiableRange},
+		{"bytes=10-5", nil, errInvalidRange},
+		{"bytes=a-b", nil, errInvalidRange},
+		{"items=0-5", nil, errInvalidRange},
+	}
+	for _, test := range tests {
+		ranges, err := parseRange(test.header, 1000)
+		assert.Equal(t, test.err, err, test.header)
+		assert.Equal(t, test.expect, ranges, test.header)
+	}
+}
+
+// serveTestRanges answers a request for a body, as handle does for a response not served in ranges
+func serveTestRanges(req *http.Request, header http.Header, body io.ReadCloser) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	resp := &web3Response{httpCode: http.StatusOK, header: header, body: body}
+	defer func() { _ = resp.body.Close() }()
+	served, err := serveRanges(w, req, resp, w)
+	if err != nil {
+		panic(err)
+	}
+	if !served {
+		w.WriteHeader(resp.httpCode)
+		_, _ = io.Copy(w, resp.body)
+	}
+	return w
+}
+
+func TestServeRanges(t *testing.T) {
+	body := "0123456789abcdefghij"
+	header := http.Header{"Content-Type": {"video/mp4"}, "Etag": {`"v1"`}}
+	stream := func() io.ReadCloser {
+		// Not seekable, with unknown size
+		return io.NopCloser(strings.NewReader(body))
+	}
+
+	req := httptest.NewRequest("GET", "/video.mp4", nil)
+	req.Header.Set("Range", "bytes=5-9")
+	w := serveTestRanges(req, header.Clone(), stream())
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 5-9/20", w.Header().Get("Content-Range"))
+	assert.Equal(t, "5", w.Header().Get("Content-Length"))
+	assert.Equal(t, "56789", w.Body.String())
+
+	// Known size, from Content-Length: the body is read up to the end of the range
+	known := header.Clone()
+	known.Set("Content-Length", "20")
+	reader := strings.NewReader(body)
+	req.Header.Set("Range", "bytes=2-3")
+	w = serveTestRanges(req, known, io.NopCloser(reader))
+	assert.Equal(t, "23", w.Body.String())
+	assert.Equal(t, 16, reader.Len())
+
+	// When too many responses are buffered already: the whole body
+	for i := 0; i < rangeMaxConcurrentBuffers; i++ {
+		rangeBuffers <- struct{}{}
+	}
+	w = serveTestRanges(req, header.Clone(), stream())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, body, w.Body.String())
+	for i := 0; i < rangeMaxConcurrentBuffers; i++ {
+		<-rangeBuffers
+	}
+
+	// Unsatisfiable
+	req.Header.Set("Range", "bytes=20-")
+	w = serveTestRanges(req, header.Clone(), stream())
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	assert.Equal(t, "bytes */20", w.Header().Get("Content-Range"))
+
+	// If-Range with another version: the whole body
+	req.Header.Set("Range", "bytes=5-9")
+	req.Header.Set("If-Range", `"v0"`)
+	w = serveTestRanges(req, header.Clone(), stream())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, body, w.Body.String())
+	req.Header.Set("If-Range", `"v1"`)
+	w = serveTestRanges(req, header.Clone(), stream())
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	req.Header.Del("If-Range")
+
+	// Multiple ranges, out of order, served from a seekable body
+	req.Header.Set("Range", "bytes=10-11,0-1")
+	w = serveTestRanges(req, header.Clone(), readSeekCloser{strings.NewReader(body), io.NopCloser(nil)})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	parts := multipart.NewReader(w.Body, params["boundary"])
+	for _, expect := range []struct{ contentRange, data string }{{"bytes 10-11/20", "ab"}, {"bytes 0-1/20", "01"}} {
+		part, err := parts.NextPart()
+		assert.NoError(t, err)
+		assert.Equal(t, "video/mp4", part.Header.Get("Content-Type"))
+		assert.Equal(t, expect.contentRange, part.Header.Get("Content-Range"))
+		data, err := io.ReadAll(part)
+		assert.NoError(t, err)
+		assert.Equal(t, expect.data, string(data))
+	}
+}
+
+func TestServeRangesReleasesBuffer(t *testing.T) {
+	defer func(maxBytes int64) { config.RangeMaxBufferBytes = maxBytes }(config.RangeMaxBufferBytes)
+	config.RangeMaxBufferBytes = 5
+	body := "0123456789abcdefghij"
+	req := httptest.NewRequest("GET", "/video.mp4", nil)
+	req.Header.Set("Range", "bytes=5-9")
+	w := httptest.NewRecorder()
+	resp := &web3Response{httpCode: http.StatusOK, header: http.Header{}, body: io.NopCloser(strings.NewReader(body))}
+
+	// Too large to be buffered: the whole body is streamed, and the buffer slot is released first
+	served, err := serveRanges(w, req, resp, w)
+	assert.NoError(t, err)
+	assert.False(t, served)
+	assert.Equal(t, 0, len(rangeBuffers))
+	data, err := io.ReadAll(resp.body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(data))
+	assert.NoError(t, resp.body.Close())
+}
+
+func TestHandleAbortsCutResponse(t *testing.T) {
+	defer func(fetch func(context.Context, string, string) (*web3Response, error)) { fetchUpstream = fetch }(fetchUpstream)
+	fetchUpstream = func(ctx context.Context, web3Url string, key string) (*web3Response, error) {
+		// The upstream fails after the first chunk of the body
+		body := io.MultiReader(strings.NewReader("01234"), iotest.ErrReader(errors.New("rpc error")))
+		header := http.Header{"Content-Type": {"video/mp4"}, "Content-Length": {"20"}, "Etag": {`"v1"`}}
+		return &web3Response{httpCode: http.StatusOK, header: header, body: io.NopCloser(body)}, nil
+	}
+
+	withResolver(&memoryResolver{}, func(now *time.Time) {
+		for _, rangeHeader := range []string{"bytes=0-9", ""} {
+			req := httptest.NewRequest("GET", "/0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:11155111/video.mp4", nil)
+			if rangeHeader != "" {
+				req.Header.Set("Range", rangeHeader)
+			}
+			rec := httptest.NewRecorder()
+			assert.PanicsWithValue(t, http.ErrAbortHandler, func() { handle(rec, req) })
+			assert.Equal(t, "01234", rec.Body.String(), "no error page after the headers")
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// requestInfo is what the handlers learn about a request while serving it, for the metrics and
+// the access logs
+type requestInfo struct {
+	requestId   string
+	web3Url     string
+	chain       string
+	contract    string
+	resolveMode string
+	nsType      string
+	cacheStatus string
+	rpcCalls    uint64 // RPC calls made for the request, counted by the RPC proxy (atomic)
+	traceId     string
+}
+
+type requestInfoKey struct{}
+
+// getRequestInfo returns the info of a request being served, to be filled by the handlers.
+// The requests which are not instrumented get a throwaway one.
+func getRequestInfo(req *http.Request) *requestInfo {
+	if info, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// responseRecorder records the status code and the body size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps the chunks of the bodies streamed, see flushWriter
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument wraps a handler to give an ID to its requests, and to record their metrics, traces
+// and access logs
+func instrument(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		info := &requestInfo{requestId: requestId(req)}
+		w.Header().Set("X-Request-ID", info.requestId)
+		ctx, span := startServerSpan(req, req.Method)
+		if span != nil {
+			info.traceId = hex.EncodeToString(span.traceId[:])
+		}
+		recorder := &responseRecorder{ResponseWriter: w}
+		// Deferred, so that the responses aborted with http.ErrAbortHandler are recorded too
+		defer func() {
+			if recorder.code == 0 {
+				recorder.code = http.StatusOK
+			}
+			duration := time.Since(start)
+			span.set("http.method", req.Method)
+			span.set("http.host", req.Host)
+			span.set("http.target", req.URL.RequestURI())
+			span.set("http.status_code", strconv.Itoa(recorder.code))
+			span.set("web3.url", info.web3Url)
+			span.set("web3.chain", info.chain)
+			span.set("request.id", info.requestId)
+			if recorder.code >= http.StatusInternalServerError {
+				span.fail(fmt.Errorf("HTTP %d", recorder.code))
+			}
+			span.finish()
+			observeRequest(info, recorder.code, recorder.bytes, duration)
+			logAccess(req, info, recorder.code, recorder.bytes, duration)
+		}()
+		handler(recorder, req.WithContext(context.WithValue(ctx, requestInfoKey{}, info)))
+	}
+}
+
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._:+/=-]{1,128}$`)
+
+// requestId returns the X-Request-ID of a request, as set by a proxy in front of the gateway, or
+// else a new random one
+func requestId(req *http.Request) string {
+	if id := req.Header.Get("X-Request-ID"); validRequestId.MatchString(id) {
+		return id
+	}
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ResponseCacheConfig configures the cache of the responses of the web3:// URLs.
+// The cached responses are the ones of the contracts (status, headers and body), before the
+// processing done by the gateway for each request (HTML patching, CORS, ...)
+type ResponseCacheConfig struct {
+	Enabled            bool
+	TTLSeconds         int         // default time to live of the responses
+	ChainTTLSeconds    map[int]int // time to live of the responses, by chain id
+	NegativeTTLSeconds int         // time to live of the 4xx responses, at most their TTL
+	MaxEntries         int         // max number of cached responses
+	MaxBytes           int64       // max size of the bodies kept in memory
+	MaxBodyBytes       int64       // larger bodies are not cached
+	VaryHeaders        []string    // request headers whose values are part of the cache key
+	DiskDir            string      // if set, the large bodies are kept in this directory
+	DiskMinBodyBytes   int64       // bodies at least this large are kept on disk
+	DiskMaxBytes       int64       // max size of the bodies kept on disk
+}
+
+// defaultResponseNegativeTTL is the time to live of the 4xx responses, e.g. of a name registered
+// right after
+const defaultResponseNegativeTTL = 10 * time.Second
+
+// Values of the Web3-Cache-Status response header
+const (
+	cacheStatusHit    = "HIT"
+	cacheStatusMiss   = "MISS"
+	cacheStatusBypass = "BYPASS"
+)
+
+// cachedResponse is a response of a web3:// URL, with its body either in memory or on disk
+type cachedResponse struct {
+	key      string
+	httpCode int
+	header   http.Header
+	chainId  int
+	nsType   string
+	body     []byte
+	bodyFile string
+	size     int64
+	stored   time.Time
+	expires  time.Time
+}
+
+// open returns a reader of the body of the response
+func (r *cachedResponse) open() (io.ReadSeekCloser, error) {
+	if r.bodyFile == "" {
+		return readSeekCloser{bytes.NewReader(r.body), io.NopCloser(nil)}, nil
+	}
+	return os.Open(r.bodyFile)
+}
+
+// responseCacheStats are the metrics of the response cache
+type responseCacheStats struct {
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"`
+	Bypasses    uint64  `json:"bypasses"`
+	Stores      uint64  `json:"stores"`
+	Evictions   uint64  `json:"evictions"`
+	Entries     int     `json:"entries"`
+	MemoryBytes int64   `json:"memoryBytes"`
+	DiskBytes   int64   `json:"diskBytes"`
+	HitRate     float64 `json:"hitRate"`
+}
+
+// responseCache is a LRU cache of responses, bounded by number of entries, and by the size of the
+// bodies in memory and on disk
+type responseCache struct {
+	config ResponseCacheConfig
+	now    func() time.Time
+
+	mu          sync.Mutex
+	entries     map[string]*list.Element
+	lru         *list.List // of *cachedResponse, most recently used first
+	memoryBytes int64
+	diskBytes   int64
+	stats       responseCacheStats
+}
+
+func newResponseCache(config ResponseCacheConfig) *responseCache {
+	if config.TTLSeconds <= 0 {
+		config.TTLSeconds = 60
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = 10000
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 256 << 20
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = 10 << 20
+	}
+	if config.DiskDir != "" {
+		if config.DiskMinBodyBytes <= 0 {
+			config.DiskMinBodyBytes = 1 << 20
+		}
+		if config.DiskMaxBytes <= 0 {
+			config.DiskMaxBytes = 4 << 30
+		}
+	}
+	return &responseCache{
+		config:  config,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+var responses *responseCache
+
+// initResponseCache sets up the response cache from the config, and clears its disk directory
+func initResponseCache() {
+	if !config.ResponseCache.Enabled {
+		return
+	}
+	responses = newResponseCache(config.ResponseCache)
+	if dir := responses.config.DiskDir; dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			log.Fatalf("Cannot create the response cache directory: %v\n", err)
+		}
+		bodyFiles, _ := filepath.Glob(filepath.Join(dir, "*.body"))
+		for _, bodyFile := range bodyFiles {
+			_ = os.Remove(bodyFile)
+		}
+	}
+}
+
+// key returns the cache key of a web3:// URL requested by a request
+func (c *responseCache) key(web3Url string, req *http.Request) string {
+	key := normalizeWeb3Url(web3Url)
+	for _, header := range c.config.VaryHeaders {
+		key += "\n" + http.CanonicalHeaderKey(header) + ": " + strings.Join(req.Header.Values(header), ", ")
+	}
+	return key
+}
+
+// normalizeWeb3Url lowercases the host of a web3:// URL (without "web3:/" prefix), and replaces
+// its chain short name by its chain id
+// e.g. web3://Quark.W3Q:w3q-g/index.txt -> web3://quark.w3q:3334/index.txt
+func normalizeWeb3Url(web3Url string) string {
+	hostname, chainId, path, err := parseWeb3Url(web3Url)
+	if err != nil {
+		return web3Url
+	}
+	hostname = strings.ToLower(hostname)
+	if chainId != "" {
+		hostname += ":" + chainId
+	}
+	return "web3://" + hostname + path
+}
+
+// ttl returns how long a response of a chain can be cached, or 0 if it must not be cached
+func (c *responseCache) ttl(httpCode int, header http.Header, chainId int) time.Duration {
+	if httpCode >= 500 {
+		return 0
+	}
+	ttl := time.Duration(c.config.TTLSeconds) * time.Second
+	if seconds, ok := c.config.ChainTTLSeconds[chainId]; ok {
+		ttl = time.Duration(seconds) * time.Second
+	}
+	// Negative caching, with its own TTL
+	if negativeTTL := secondsOr(c.config.NegativeTTLSeconds, defaultResponseNegativeTTL); httpCode >= 400 && negativeTTL < ttl {
+		ttl = negativeTTL
+	}
+	// The contract can ask for a shorter lifetime, or no caching at all
+	for _, directive := range strings.Split(strings.ToLower(header.Get("Cache-Control")), ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-store" || directive == "no-cache" || directive == "private":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && time.Duration(seconds)*time.Second < ttl {
+				ttl = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return ttl
+}
+
+// get returns the fresh cached response of a key, or nil
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil
+	}
+	entry := element.Value.(*cachedResponse)
+	if c.now().After(entry.expires) {
+		c.remove(element)
+		c.stats.Misses++
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	c.stats.Hits++
+	return entry
+}
+
+// bypass counts a request not served from cache
+func (c *responseCache) bypass() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Bypasses++
+}
+
+// put stores a response, evicting the least recently used ones beyond the bounds of the cache
+func (c *responseCache) put(entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	if entry.bodyFile != "" {
+		c.diskBytes += entry.size
+	} else {
+		c.memoryBytes += entry.size
+	}
+	c.stats.Stores++
+	for c.lru.Len() > c.config.MaxEntries {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+	// Each tier evicts its own least recently used entries
+	for element := c.lru.Back(); element != nil && (c.memoryBytes > c.config.MaxBytes || c.diskBytes > c.config.DiskMaxBytes); {
+		prev := element.Prev()
+		onDisk := element.Value.(*cachedResponse).bodyFile != ""
+		if onDisk && c.diskBytes > c.config.DiskMaxBytes || !onDisk && c.memoryBytes > c.config.MaxBytes {
+			c.remove(element)
+			c.stats.Evictions++
+		}
+		element = prev
+	}
+}
+
+func (c *responseCache) remove(element *list.Element) {
+	entry := element.Value.(*cachedResponse)
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+	if entry.bodyFile != "" {
+		c.diskBytes -= entry.size
+		// Readers having the file open can still read it
+		if err := os.Remove(entry.bodyFile); err != nil {
+			log.Errorf("Cannot remove cached body: %v\n", err)
+		}
+	} else {
+		c.memoryBytes -= entry.size
+	}
+}
+
+// getStats returns a snapshot of the metrics of the cache
+func (c *responseCache) getStats() responseCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.MemoryBytes = c.memoryBytes
+	stats.DiskBytes = c.diskBytes
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// responseCapture copies a body while it is streamed to the client, and stores the response in
+// the cache once the body has been read entirely. Bodies larger than DiskMinBodyBytes are spilled
+// to disk if the disk tier is enabled, and bodies larger than MaxBodyBytes are not cached.
+// Responses without ETag get one computed from their body.
+type responseCapture struct {
+	cache   *responseCache
+	entry   *cachedResponse
+	r       io.ReadCloser
+	buf     bytes.Buffer
+	file    *os.File
+	hash    hash.Hash
+	aborted bool
+}
+
+func (rc *responseCapture) Read(p []byte) (int, error) {
+	n, err := rc.r.Read(p)
+	if n > 0 && !rc.aborted {
+		rc.write(p[:n])
+	}
+	if err == io.EOF && !rc.aborted {
+		rc.commit()
+	} else if err != nil && err != io.EOF {
+		rc.abort()
+	}
+	return n, err
+}
+
+// Close discards the capture if the body was not read entirely
+func (rc *responseCapture) Close() error {
+	rc.abort()
+	return rc.r.Close()
+}
+
+func (rc *responseCapture) write(p []byte) {
+	rc.entry.size += int64(len(p))
+	if rc.entry.size > rc.cache.config.MaxBodyBytes {
+		rc.abort()
+		return
+	}
+	if rc.hash == nil {
+		rc.hash = sha256.New()
+	}
+	rc.hash.Write(p)
+	if rc.file == nil && rc.cache.config.DiskDir != "" && rc.entry.size >= rc.cache.config.DiskMinBodyBytes {
+		file, err := os.CreateTemp(rc.cache.config.DiskDir, "*.body")
+		if err != nil {
+			log.Errorf("Cannot create cached body: %v\n", err)
+			rc.abort()
+			return
+		}
+		rc.file = file
+		if _, err := rc.file.Write(rc.buf.Bytes()); err != nil {
+			log.Errorf("Cannot write cached body: %v\n", err)
+			rc.abort()
+			return
+		}
+		rc.buf = bytes.Buffer{}
+	}
+	if rc.file != nil {
+		if _, err := rc.file.Write(p); err != nil {
+			log.Errorf("Cannot write cached body: %v\n", err)
+			rc.abort()
+		}
+		return
+	}
+	rc.buf.Write(p)
+}
+
+func (rc *responseCapture) commit() {
+	rc.aborted = true
+	if rc.file != nil {
+		if err := rc.file.Close(); err != nil {
+			log.Errorf("Cannot store cached body: %v\n", err)
+			_ = os.Remove(rc.file.Name())
+			return
+		}
+		rc.entry.bodyFile = rc.file.Name()
+	} else {
+		rc.entry.body = rc.buf.Bytes()
+	}
+	if rc.entry.header.Get("ETag") == "" && rc.entry.httpCode == http.StatusOK {
+		if rc.hash == nil {
+			rc.hash = sha256.New()
+		}
+		rc.entry.header.Set("ETag", etagFromHash(rc.hash))
+	}
+	rc.cache.put(rc.entry)
+}
+
+func (rc *responseCapture) abort() {
+	if rc.aborted {
+		return
+	}
+	rc.aborted = true
+	rc.buf = bytes.Buffer{}
+	if rc.file != nil {
+		_ = rc.file.Close()
+		_ = os.Remove(rc.file.Name())
+	}
+}
+
+// handleResponseCacheStats serves the metrics of the response cache
+func handleResponseCacheStats(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	stats := responseCacheStats{}
+	if responses != nil {
+		stats = responses.getStats()
+	}
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Errorf("Cannot write response cache stats: %v\n", err)
+	}
+}
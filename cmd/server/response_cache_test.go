@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// capture streams a body through a responseCapture, as handle does
+func capture(t *testing.T, cache *responseCache, key string, body string) {
+	rc := &responseCapture{
+		cache: cache,
+		r:     io.NopCloser(iotest.OneByteReader(strings.NewReader(body))),
+		entry: &cachedResponse{key: key, httpCode: 200, header: http.Header{}, expires: cache.now().Add(time.Minute)},
+	}
+	data, err := io.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(data))
+	assert.NoError(t, rc.Close())
+}
+
+func cachedBody(t *testing.T, cache *responseCache, key string) (string, bool) {
+	entry := cache.get(key)
+	if entry == nil {
+		return "", false
+	}
+	body, err := entry.open()
+	assert.NoError(t, err)
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	assert.NoError(t, err)
+	return string(data), true
+}
+
+func TestResponseCacheBounds(t *testing.T) {
+	cache := newResponseCache(ResponseCacheConfig{MaxEntries: 3, MaxBytes: 10, MaxBodyBytes: 6})
+
+	capture(t, cache, "a", "aaaa")
+	capture(t, cache, "b", "bbbb")
+	// Too large: not cached
+	capture(t, cache, "c", "ccccccc")
+	_, ok := cachedBody(t, cache, "c")
+	assert.False(t, ok)
+
+	// "a" is used, so "b" is the least recently used one, and is evicted to stay under MaxBytes
+	body, ok := cachedBody(t, cache, "a")
+	assert.True(t, ok)
+	assert.Equal(t, "aaaa", body)
+	capture(t, cache, "d", "dddd")
+	_, ok = cachedBody(t, cache, "b")
+	assert.False(t, ok)
+	_, ok = cachedBody(t, cache, "a")
+	assert.True(t, ok)
+
+	// Entries bound
+	capture(t, cache, "e", "")
+	capture(t, cache, "f", "")
+	assert.Equal(t, 3, cache.getStats().Entries)
+	assert.LessOrEqual(t, cache.getStats().MemoryBytes, int64(10))
+}
+
+func TestResponseCacheExpiration(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := newResponseCache(ResponseCacheConfig{})
+	cache.now = func() time.Time { return now }
+
+	capture(t, cache, "a", "aaaa")
+	_, ok := cachedBody(t, cache, "a")
+	assert.True(t, ok)
+	now = now.Add(time.Minute + time.Second)
+	_, ok = cachedBody(t, cache, "a")
+	assert.False(t, ok)
+}
+
+func TestResponseCacheIncompleteBody(t *testing.T) {
+	cache := newResponseCache(ResponseCacheConfig{})
+	rc := &responseCapture{
+		cache: cache,
+		r:     io.NopCloser(strings.NewReader("aaaa")),
+		entry: &cachedResponse{key: "a", httpCode: 200, header: http.Header{}, expires: cache.now().Add(time.Minute)},
+	}
+	// The client went away before the end of the body
+	_, err := rc.Read(make([]byte, 2))
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	_, ok := cachedBody(t, cache, "a")
+	assert.False(t, ok)
+
+	rc = &responseCapture{
+		cache: cache,
+		r:     io.NopCloser(iotest.TimeoutReader(strings.NewReader("aaaa"))),
+		entry: &cachedResponse{key: "a", httpCode: 200, header: http.Header{}, expires: cache.now().Add(time.Minute)},
+	}
+	_, err = io.ReadAll(rc)
+	assert.Error(t, err)
+	_, ok = cachedBody(t, cache, "a")
+	assert.False(t, ok)
+}
+
+func TestResponseCacheDisk(t *testing.T) {
+	dir := t.TempDir()
+	cache := newResponseCache(ResponseCacheConfig{MaxBytes: 100, DiskDir: dir, DiskMinBodyBytes: 8, DiskMaxBytes: 40})
+
+	capture(t, cache, "small", "small")
+	large := strings.Repeat("large", 5)
+	capture(t, cache, "large", large)
+	body, ok := cachedBody(t, cache, "large")
+	assert.True(t, ok)
+	assert.Equal(t, large, body)
+	stats := cache.getStats()
+	assert.Equal(t, int64(5), stats.MemoryBytes)
+	assert.Equal(t, int64(25), stats.DiskBytes)
+
+	// Replacing and evicting entries remove their files
+	capture(t, cache, "large", large)
+	capture(t, cache, "large2", large)
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	body, ok = cachedBody(t, cache, "large2")
+	assert.True(t, ok)
+	assert.Equal(t, large, body)
+	_, ok = cachedBody(t, cache, "small")
+	assert.True(t, ok)
+}
+
+func TestResponseCacheTTL(t *testing.T) {
+	cache := newResponseCache(ResponseCacheConfig{TTLSeconds: 60, ChainTTLSeconds: map[int]int{1: 600, 5: 0}})
+	tests := []struct {
+		httpCode     int
+		cacheControl string
+		chainId      int
+		expect       time.Duration
+	}{
+		{200, "", 3334, time.Minute},
+		{200, "", 1, 10 * time.Minute},
+		{200, "", 5, 0},
+		{404, "", 1, 10 * time.Second},
+		{404, "", 5, 0},
+		{500, "", 1, 0},
+		{200, "public, max-age=30", 1, 30 * time.Second},
+		{200, "max-age=3600", 3334, time.Minute},
+		{200, "no-store", 1, 0},
+		{200, "Private", 1, 0},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.cacheControl != "" {
+			header.Set("Cache-Control", test.cacheControl)
+		}
+		assert.Equal(t, test.expect, cache.ttl(test.httpCode, header, test.chainId), "%+v", test)
+	}
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	cache := newResponseCache(ResponseCacheConfig{VaryHeaders: []string{"accept-language"}})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Language", "fr")
+	assert.Equal(t, "web3://quark.w3q:3334/index.txt?a=1\nAccept-Language: fr", cache.key("web3://Quark.W3Q:w3q-g/index.txt?a=1", req))
+	assert.Equal(t, "web3://0x6587e67f1fbeaabdee8b70efb396e750e216283b/", normalizeWeb3Url("web3://0x6587e67F1FBEAabDEe8b70EFb396E750e216283B/"))
+}
+
+func TestFetchWeb3ResponseFromCache(t *testing.T) {
+	defer func(cache *responseCache) { responses = cache }(responses)
+	responses = newResponseCache(ResponseCacheConfig{})
+	header := http.Header{"Content-Type": {"text/plain"}, "Web3-Chain-Id": {"3334"}}
+	responses.put(&cachedResponse{
+		key:      "web3://quark.w3q:3334/index.txt",
+		httpCode: 200,
+		header:   header,
+		chainId:  3334,
+		nsType:   "w3ns",
+		body:     []byte("hello, world"),
+		size:     12,
+		expires:  time.Now().Add(time.Minute),
+	})
+
+	req := httptest.NewRequest("GET", "/index.txt", nil)
+	resp, err := fetchWeb3Response("web3://quark.w3q:w3q-g/index.txt", req)
+	assert.NoError(t, err)
+	assert.Equal(t, cacheStatusHit, resp.cacheStatus)
+	assert.Equal(t, 200, resp.httpCode)
+	assert.Equal(t, 3334, resp.chainId)
+	assert.Equal(t, header, resp.header)
+	var body bytes.Buffer
+	_, err = io.Copy(&body, resp.body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, world", body.String())
+
+	// The cached headers are not altered by the requests
+	resp.header.Set("Content-Type", "text/html")
+	assert.Equal(t, "text/plain", header.Get("Content-Type"))
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// A host route describes how the subdomain of a gateway host (the part before the gateway
+// domain) is mapped to a web3:// host. The pattern is a list of dot-separated labels, which are
+// either literals or one of these placeholders:
+// - {address}: a contract hex address
+// - {name}: a label of a domain name; can be repeated, e.g. {name}.{name}.{tld}
+// - {tld}: the domain name service suffix, e.g. eth. If absent, TLD is used (or the domain name
+// service of the default chain, if TLD is empty)
+// - {chain}: a chain id or chain short name. If absent, Chain is used (or the default chain for
+// addresses, if Chain is 0)
+// Routes are tried in order, the first matching one is used.
+// Examples:
+// {address}.{chain} : 0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.sep.w3link.io -> web3://0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:11155111
+// {name}.{tld}.{chain} : quark.w3q.w3q-g.w3link.io -> web3://quark.w3q:3334
+// {name} with TLD "eth" : quark.w3eth.io -> web3://quark.eth
+type HostRoute struct {
+	Pattern string
+	TLD     string
+	Chain   int
+}
+
+const (
+	routeAddress = "{address}"
+	routeName    = "{name}"
+	routeTLD     = "{tld}"
+	routeChain   = "{chain}"
+)
+
+var routeLiteralRegexp = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// defaultHostRoutes returns the host layouts used when no route is configured
+func defaultHostRoutes() []HostRoute {
+	// https://[web3-hex-address | web3-host-name].[gateway-host].[gateway-tld]
+	// https://[web3-hex-address].[web3-chain-id | web3-chain-shortname].[gateway-host].[gateway-tld]
+	routes := []HostRoute{
+		{Pattern: routeAddress},
+		{Pattern: routeName},
+		{Pattern: routeAddress + "." + routeChain},
+	}
+	// Explicit domain names are only accepted without default chain
+	// https://[web3-host-name].[web3-host-tld].[web3-chain-id | web3-chain-shortname].[gateway-host].[gateway-tld]
+	// https://[web3-host-subdomain].[web3-host-name].[web3-host-tld].[web3-chain-id | web3-chain-shortname].[gateway-host].[gateway-tld]
+	if config.DefaultChain == 0 {
+		routes = append(routes,
+			HostRoute{Pattern: routeName + "." + routeTLD + "." + routeChain},
+			HostRoute{Pattern: routeName + "." + routeName + "." + routeTLD + "." + routeChain},
+		)
+	}
+	return routes
+}
+
+// hostRoutes returns the configured host routes, or the default ones
+func hostRoutes() []HostRoute {
+	if len(config.HostRoutes) > 0 {
+		return config.HostRoutes
+	}
+	return defaultHostRoutes()
+}
+
+// validateHostRoutes checks the patterns of the configured host routes
+func validateHostRoutes() error {
+	for _, route := range config.HostRoutes {
+		if err := route.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (route HostRoute) labels() []string {
+	return strings.Split(strings.ToLower(route.Pattern), ".")
+}
+
+func (route HostRoute) count(placeholder string) (count int) {
+	for _, label := range route.labels() {
+		if label == placeholder {
+			count++
+		}
+	}
+	return
+}
+
+func (route HostRoute) validate() error {
+	for _, label := range route.labels() {
+		switch label {
+		case routeAddress, routeName, routeTLD, routeChain:
+		default:
+			if !routeLiteralRegexp.MatchString(label) {
+				return fmt.Errorf("host route %v: invalid label %v", route.Pattern, label)
+			}
+		}
+	}
+	addresses, names := route.count(routeAddress), route.count(routeName)
+	if addresses+names == 0 || addresses > 0 && names > 0 {
+		return fmt.Errorf("host route %v: exactly one of %v or %v is expected", route.Pattern, routeAddress, routeName)
+	}
+	if addresses > 1 || route.count(routeTLD) > 1 || route.count(routeChain) > 1 {
+		return fmt.Errorf("host route %v: %v, %v and %v can only be used once", route.Pattern, routeAddress, routeTLD, routeChain)
+	}
+	if addresses > 0 && route.count(routeTLD) > 0 {
+		return fmt.Errorf("host route %v: %v cannot be used with %v", route.Pattern, routeTLD, routeAddress)
+	}
+	return nil
+}
+
+// tld returns the domain name service suffix used by a route without {tld}
+func (route HostRoute) tld() (string, error) {
+	if route.TLD != "" {
+		return route.TLD, nil
+	}
+	return getDefaultNSSuffix()
+}
+
+// chain returns the chain used by an address route without {chain}
+func (route HostRoute) addressChain() int {
+	if route.Chain > 0 {
+		return route.Chain
+	}
+	return config.DefaultChain
+}
+
+// match tries to map the subdomain labels of a host to a web3:// host and chain (id or short
+// name, possibly empty)
+func (route HostRoute) match(subdomainParts []string) (web3Host string, chain string, ok bool, err error) {
+	labels := route.labels()
+	if len(labels) != len(subdomainParts) {
+		return "", "", false, nil
+	}
+
+	var address, tld string
+	var names []string
+	for i, label := range labels {
+		part := subdomainParts[i]
+		switch label {
+		case routeAddress:
+			if !common.IsHexAddress(part) {
+				return "", "", false, nil
+			}
+			address = part
+		case routeName:
+			if common.IsHexAddress(part) {
+				return "", "", false, nil
+			}
+			names = append(names, part)
+		case routeTLD:
+			tld = part
+		case routeChain:
+			chain = part
+		default:
+			if !strings.EqualFold(label, part) {
+				return "", "", false, nil
+			}
+		}
+	}
+
+	if address != "" {
+		if chain == "" {
+			if route.addressChain() == 0 {
+				return "", "", false, fmt.Errorf("default chain is not specified")
+			}
+			chain = strconv.Itoa(route.addressChain())
+		}
+		return address, chain, true, nil
+	}
+
+	if route.count(routeTLD) == 0 {
+		tld, err = route.tld()
+		if err != nil {
+			return "", "", false, err
+		}
+	}
+	if chain == "" && route.Chain > 0 {
+		chain = strconv.Itoa(route.Chain)
+	}
+	return strings.Join(names, ".") + "." + tld, chain, true, nil
+}
+
+// render is the inverse of match: it returns the subdomain labels under which a web3:// host and
+// chain id (possibly empty) are served, or ok = false if the route cannot serve them
+func (route HostRoute) render(web3Host string, chainId string) (subdomainParts []string, ok bool) {
+	labels := route.labels()
+	isAddress := common.IsHexAddress(web3Host)
+	if isAddress != (route.count(routeAddress) > 0) {
+		return nil, false
+	}
+
+	var names []string
+	tld := ""
+	if !isAddress {
+		hostParts := strings.Split(web3Host, ".")
+		if len(hostParts) != route.count(routeName)+1 {
+			return nil, false
+		}
+		names, tld = hostParts[:len(hostParts)-1], hostParts[len(hostParts)-1]
+		if route.count(routeTLD) == 0 {
+			routeTld, err := route.tld()
+			if err != nil || routeTld != tld {
+				return nil, false
+			}
+		}
+	}
+
+	// Chain: either written in the host, or implied by the route
+	if route.count(routeChain) > 0 {
+		if chainId == "" {
+			chainId = implicitChainId(web3Host)
+		}
+		if chainId == "" {
+			return nil, false
+		}
+	} else {
+		routeChainId := route.Chain
+		if isAddress {
+			routeChainId = route.addressChain()
+		}
+		switch {
+		case routeChainId == 0:
+			// The web3:// URL is left without chain
+			if isAddress || chainId != "" {
+				return nil, false
+			}
+		case chainId == "":
+			if implicitChainId(web3Host) != strconv.Itoa(routeChainId) {
+				return nil, false
+			}
+		case chainId != strconv.Itoa(routeChainId):
+			return nil, false
+		}
+	}
+
+	for _, label := range labels {
+		switch label {
+		case routeAddress:
+			subdomainParts = append(subdomainParts, web3Host)
+		case routeName:
+			subdomainParts = append(subdomainParts, names[0])
+			names = names[1:]
+		case routeTLD:
+			subdomainParts = append(subdomainParts, tld)
+		case routeChain:
+			subdomainParts = append(subdomainParts, chainId)
+		default:
+			subdomainParts = append(subdomainParts, label)
+		}
+	}
+	return subdomainParts, true
+}
+
+// isGatewayHost tells if a host name (without port) is one of config.GatewayDomains or one of
+// their subdomains
+func isGatewayHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range config.GatewayDomains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesHostRoute tells if a host (without port) is a gateway host under a host route which
+// identifies it unambiguously, i.e. with a contract address or a known chain. Names alone are not
+// conclusive: e.g. docs.ourproject.org matches {name} on a gateway with a default chain.
+func matchesHostRoute(host string) bool {
+	subdomainParts, _ := splitGatewayHost(host)
+	if len(subdomainParts) == 0 {
+		return false
+	}
+	for _, route := range hostRoutes() {
+		web3Host, chain, ok, err := route.match(subdomainParts)
+		if err != nil || !ok {
+			continue
+		}
+		if common.IsHexAddress(web3Host) {
+			return true
+		}
+		if route.count(routeChain) > 0 {
+			if _, ok := config.Name2Chain[chain]; ok {
+				return true
+			}
+			if chainId, err := strconv.Atoi(chain); err == nil && chainId > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitGatewayHost splits a host name (without port) into its subdomain labels and the gateway
+// domain. The gateway domain is the longest matching domain of config.GatewayDomains, or the
+// last two labels of the host if none matches.
+// e.g. quark.w3q.w3q-g.w3link.io -> [quark, w3q, w3q-g], w3link.io
+func splitGatewayHost(host string) (subdomainParts []string, gatewayDomain string) {
+	lowerHost := strings.ToLower(host)
+	for _, domain := range config.GatewayDomains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if len(domain) <= len(gatewayDomain) {
+			continue
+		}
+		if lowerHost == domain || strings.HasSuffix(lowerHost, "."+domain) {
+			gatewayDomain = domain
+		}
+	}
+
+	if gatewayDomain == "" {
+		hostParts := strings.Split(host, ".")
+		if len(hostParts) <= 2 {
+			return nil, host
+		}
+		return hostParts[:len(hostParts)-2], strings.Join(hostParts[len(hostParts)-2:], ".")
+	}
+
+	if len(host) == len(gatewayDomain) {
+		return nil, host[len(host)-len(gatewayDomain):]
+	}
+	return strings.Split(host[:len(host)-len(gatewayDomain)-1], "."), host[len(host)-len(gatewayDomain):]
+}
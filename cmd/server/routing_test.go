@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var routedHosts = []struct {
+	host   string
+	path   string
+	expect string
+}{
+	{"quark.gw.example.co.uk", "/index.txt", "/quark.eth:5/index.txt"},
+	{"quark.w3q.gw.example.co.uk:8443", "/index.txt", "/quark.w3q/index.txt"},
+	{"0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.sep.web3.corp.internal", "/name", "/0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:11155111/name"},
+	{"dblog.dblog.eth.11155111.gw.example.co.uk", "/", "/dblog.dblog.eth:11155111/"},
+	{"app.dblog.eth.sep.gw.example.co.uk", "/", "/dblog.eth:11155111/"},
+	{"gw.example.co.uk", "/quark.eth:gor/index.txt", "/quark.eth:5/index.txt"},
+	// not a configured gateway domain: the last two labels are the gateway domain
+	{"quark.w3q.w3q-g.w3link.io", "/index.txt", "/quark.w3q:3334/index.txt"},
+	// no matching route
+	{"a.b.c.d.e.gw.example.co.uk", "/", ""},
+	{"0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.gw.example.co.uk", "/", ""},
+}
+
+func TestHostRoutes(t *testing.T) {
+	hostRoutes := []HostRoute{
+		{Pattern: "{name}", TLD: "eth", Chain: 5},
+		{Pattern: "{name}.{tld}"},
+		{Pattern: "{address}.{chain}"},
+		{Pattern: "app.{name}.{tld}.{chain}"},
+		{Pattern: "{name}.{name}.{tld}.{chain}"},
+		{Pattern: "{name}.{tld}.{chain}"},
+	}
+	withGatewayConfig(0, []string{"example.co.uk", "gw.example.co.uk", "web3.corp.internal"}, hostRoutes, func() {
+		for _, test := range routedHosts {
+			t.Run(test.host+test.path, func(t *testing.T) {
+				p, _, err := handleSubdomain(test.host, test.path)
+				if test.expect == "" {
+					assert.Error(t, err)
+				} else {
+					assert.NoError(t, err)
+					assert.Equal(t, test.expect, p)
+				}
+			})
+		}
+	})
+}
+
+func TestHostedDwebPaths(t *testing.T) {
+	withGatewayConfig(1, []string{"w3eth.io", "w3link.io"}, nil, func() {
+		// The first path segment of an address subdomain is kept...
+		p, _, err := handleSubdomain("0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.w3eth.io", "/foo.eth/x")
+		assert.NoError(t, err)
+		assert.Equal(t, "/0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:1/foo.eth/x", p)
+		// ...unless the subdomain has a chain: it replaces the name of a hosted dweb file
+		p, _, err = handleSubdomain("0x9616fd0f0afc5d39c518289d1c1189a50bde94f5.sep.w3link.io", "/foo.eth/x")
+		assert.NoError(t, err)
+		assert.Equal(t, "/0x9616fd0f0afc5d39c518289d1c1189a50bde94f5:11155111/x", p)
+	})
+}
+
+func TestValidateHostRoutes(t *testing.T) {
+	assert.NoError(t, HostRoute{Pattern: "{name}.{name}.{tld}.{chain}"}.validate())
+	assert.NoError(t, HostRoute{Pattern: "app.{address}"}.validate())
+	assert.Error(t, HostRoute{Pattern: "{chain}"}.validate())
+	assert.Error(t, HostRoute{Pattern: "{address}.{name}"}.validate())
+	assert.Error(t, HostRoute{Pattern: "{address}.{tld}"}.validate())
+	assert.Error(t, HostRoute{Pattern: "{name}.{chain}.{chain}"}.validate())
+	assert.Error(t, HostRoute{Pattern: "{name}.a_b"}.validate())
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The budget of the RPC requests of a chain, and of each of its endpoints, is limited by a token
+// bucket (requests per second, with a burst) and a maximum of requests in flight. The requests
+// over budget wait for up to RPCQueueMillis, and then fail with 503 and Retry-After.
+
+const defaultRPCQueueTimeout = 500 * time.Millisecond
+
+// rpcLimiter is a token bucket, and a semaphore of the requests in flight
+type rpcLimiter struct {
+	rate        float64 // tokens per second; 0 for no rate limit
+	burst       float64
+	maxInFlight int // 0 for no limit
+
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+	inFlight int
+	released chan struct{} // closed when a request finishes, to wake up the waiting ones
+	stats    rpcLimiterStats
+}
+
+// rpcLimiterStats are the throttling metrics of a chain or an endpoint
+type rpcLimiterStats struct {
+	Requests  uint64 `json:"requests"`  // requests within the budget
+	Queued    uint64 `json:"queued"`    // requests within the budget after waiting
+	Throttled uint64 `json:"throttled"` // requests over the budget: failed, or sent to another endpoint
+	InFlight  int    `json:"inFlight"`
+}
+
+// newRPCLimiter returns a limiter, or nil if there is no limit
+func newRPCLimiter(rate float64, burst int, maxInFlight int) *rpcLimiter {
+	if rate <= 0 && maxInFlight <= 0 {
+		return nil
+	}
+	l := &rpcLimiter{
+		rate:        math.Max(rate, 0),
+		burst:       burstOr(burst, rate),
+		maxInFlight: maxInFlight,
+		last:        time.Now(),
+		released:    make(chan struct{}),
+	}
+	l.tokens = l.burst
+	return l
+}
+
+// reserve takes a token and a slot if both are available. Otherwise, it returns how long to wait
+// for the next token, or 0 if a request in flight must finish first.
+func (l *rpcLimiter) reserve(now time.Time) (time.Duration, bool) {
+	if l.rate > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+	}
+	if l.maxInFlight > 0 && l.inFlight >= l.maxInFlight {
+		return 0, false
+	}
+	if l.rate > 0 && l.tokens < 1 {
+		return time.Duration((1 - l.tokens) / l.rate * float64(time.Second)), false
+	}
+	if l.rate > 0 {
+		l.tokens--
+	}
+	l.inFlight++
+	return 0, true
+}
+
+// acquire waits for up to maxWait for the budget of a request. It returns the function releasing
+// it once the request is done, or else when to retry.
+func (l *rpcLimiter) acquire(ctx context.Context, maxWait time.Duration) (func(), time.Duration, bool) {
+	if l == nil {
+		return func() {}, 0, true
+	}
+	deadline := time.Now().Add(maxWait)
+	queued := false
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		wait, ok := l.reserve(now)
+		if ok {
+			l.stats.Requests++
+			if queued {
+				l.stats.Queued++
+			}
+			l.mu.Unlock()
+			return l.release, 0, true
+		}
+		released := l.released
+		remaining := deadline.Sub(now)
+		if remaining <= 0 || wait > remaining {
+			l.stats.Throttled++
+			l.mu.Unlock()
+			if wait == 0 {
+				// Requests in flight last up to the RPC timeout, but most are much shorter
+				wait = time.Second
+			}
+			return nil, wait, false
+		}
+		l.mu.Unlock()
+
+		queued = true
+		if wait == 0 {
+			wait = remaining
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-released:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, 0, false
+		}
+		timer.Stop()
+	}
+}
+
+func (l *rpcLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+func (l *rpcLimiter) getStats() *rpcLimiterStats {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.InFlight = l.inFlight
+	return &stats
+}
+
+// rpcThrottledError is the error of a request over the RPC budget of a chain
+type rpcThrottledError struct {
+	chainId    int
+	retryAfter time.Duration
+}
+
+func (e *rpcThrottledError) Error() string {
+	return fmt.Sprintf("RPC budget of chain %d exhausted, retry after %ss", e.chainId, e.retryAfterSeconds())
+}
+
+func (e *rpcThrottledError) retryAfterSeconds() string {
+	return retryAfterSeconds(e.retryAfter)
+}
+
+// retryAfterSeconds returns the value of the Retry-After header: a number of seconds, at least 1
+func retryAfterSeconds(retryAfter time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds()))))
+}
+
+// The message of rpcThrottledError, as returned by the RPC proxy to web3protocol-go, which passes
+// it on in its own errors
+var rpcThrottledPattern = regexp.MustCompile(`RPC budget of chain (\d+) exhausted, retry after (\d+)s`)
+
+// asRPCThrottled returns the rpcThrottledError behind an error of web3protocol-go, or nil
+func asRPCThrottled(err error) *rpcThrottledError {
+	var throttled *rpcThrottledError
+	if errors.As(err, &throttled) {
+		return throttled
+	}
+	match := rpcThrottledPattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return nil
+	}
+	chainId, _ := strconv.Atoi(match[1])
+	seconds, _ := strconv.Atoi(match[2])
+	return &rpcThrottledError{chainId: chainId, retryAfter: time.Duration(seconds) * time.Second}
+}
+
+// handleRPCThrottlingStats serves the throttling metrics of the chains with an RPC budget
+func handleRPCThrottlingStats(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	stats := map[string]*rpcLimiterStats{}
+	for chainId, pool := range rpcPools {
+		if chainStats := pool.limiter.getStats(); chainStats != nil {
+			stats[strconv.Itoa(chainId)] = chainStats
+		}
+	}
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Errorf("Cannot write RPC throttling stats: %v\n", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRPCLimiter(t *testing.T) {
+	assert.Nil(t, newRPCLimiter(0, 10, 0))
+
+	// Token bucket: the burst, then one request every 100ms
+	limiter := newRPCLimiter(10, 2, 0)
+	for i := 0; i < 2; i++ {
+		release, _, ok := limiter.acquire(context.Background(), 0)
+		assert.True(t, ok)
+		release()
+	}
+	_, retryAfter, ok := limiter.acquire(context.Background(), 0)
+	assert.False(t, ok)
+	assert.InDelta(t, 100*time.Millisecond, retryAfter, float64(20*time.Millisecond))
+	_, _, ok = limiter.acquire(context.Background(), 300*time.Millisecond)
+	assert.True(t, ok)
+	assert.Equal(t, rpcLimiterStats{Requests: 3, Queued: 1, Throttled: 1, InFlight: 1}, *limiter.getStats())
+
+	// Requests in flight: a waiting request goes on once another one is done
+	limiter = newRPCLimiter(0, 0, 1)
+	release, _, ok := limiter.acquire(context.Background(), 0)
+	assert.True(t, ok)
+	time.AfterFunc(20*time.Millisecond, release)
+	start := time.Now()
+	_, _, ok = limiter.acquire(context.Background(), time.Second)
+	assert.True(t, ok)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	_, retryAfter, ok = limiter.acquire(context.Background(), 10*time.Millisecond)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+}
+
+func TestRPCPoolThrottling(t *testing.T) {
+	limited, limitedServer := newRPCStandIn(t, 1, 100)
+	other, otherServer := newRPCStandIn(t, 1, 100)
+	pool := newRPCPool(1, []RPCEndpoint{{URL: limitedServer.URL, RateLimit: 0.1, Burst: 1}, {URL: otherServer.URL, Priority: 1}})
+	pool.queueTimeout = 10 * time.Millisecond
+
+	// Over the budget of an endpoint, the others are used
+	for i := 0; i < 3; i++ {
+		code, _ := rpcPost(pool)
+		assert.Equal(t, http.StatusOK, code)
+	}
+	assert.Equal(t, 1, limited.getRequests())
+	assert.Equal(t, 2, other.getRequests())
+	assert.Equal(t, uint64(2), pool.getStatus()[0].Throttling.Throttled)
+
+	// Over the budget of an endpoint, with no other one
+	other.set(http.StatusBadGateway, 100)
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, httptest.NewRequest("POST", "/chain/1", strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Retry-After"))
+
+	// Over the budget of the chain
+	other.set(0, 100)
+	pool.limiter = newRPCLimiter(0.5, 1, 0)
+	code, _ := rpcPost(pool)
+	assert.Equal(t, http.StatusOK, code)
+	w = httptest.NewRecorder()
+	pool.ServeHTTP(w, httptest.NewRequest("POST", "/chain/1", strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+	// The error, as passed on by web3protocol-go
+	throttled := asRPCThrottled(errors.New("503 Service Unavailable: " + w.Body.String()))
+	assert.Equal(t, &rpcThrottledError{chainId: 1, retryAfter: 2 * time.Second}, throttled)
+	assert.Nil(t, asRPCThrottled(errors.New("execution reverted")))
+}
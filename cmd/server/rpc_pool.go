@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RPC endpoints: each chain can have several RPC endpoints. web3protocol-go is given one RPC URL
+// per chain, which is a local proxy forwarding each JSON-RPC request to the best endpoint of the
+// chain, and failing over to the next ones on errors and timeouts. The endpoints are probed in the
+// background, and those failing repeatedly are left aside for a while (circuit breaking).
+// The endpoints serving another chain than the one they are configured for (e.g. a Goerli RPC
+// under the mainnet chain id) are never used: they are quarantined, or refused at startup.
+
+// RPCEndpoint is an RPC endpoint of a chain
+type RPCEndpoint struct {
+	URL      string
+	Priority int // the endpoints with the lowest priority are used first
+	Weight   int // share of the requests among the endpoints of the same priority; default 1
+
+	// Budget of the endpoint; when exhausted, the requests go to the other endpoints
+	RateLimit   float64 // requests per second
+	Burst       int     // default: RateLimit
+	MaxInFlight int
+}
+
+// Defaults of the RPC settings
+const (
+	defaultRPCTimeout          = 10 * time.Second
+	defaultRPCHealthCheck      = 15 * time.Second
+	defaultRPCCircuitOpen      = 30 * time.Second
+	defaultRPCFailureThreshold = 3
+	defaultRPCMaxBlockLag      = 10
+	maxRPCRequestBytes         = 10 << 20
+	rpcStartupCheckTimeout     = 5 * time.Second
+)
+
+// Values of the RPCChainIdMismatch setting
+const (
+	rpcChainIdMismatchQuarantine = "quarantine" // default: the endpoint is not used until it serves the right chain
+	rpcChainIdMismatchRefuse     = "refuse"     // the gateway does not start
+)
+
+// rpcEndpoint is an RPC endpoint, with its health
+type rpcEndpoint struct {
+	RPCEndpoint
+	limiter *rpcLimiter
+
+	mu                  sync.Mutex
+	healthy             bool
+	quarantined         bool   // serves another chain
+	servedChainId       uint64 // as returned by eth_chainId
+	consecutiveFailures int
+	circuitOpenUntil    time.Time
+	latestBlock         uint64
+	lastError           string
+	lastCheck           time.Time
+	requests            uint64
+	failures            uint64
+}
+
+// rpcPool forwards the JSON-RPC requests of a chain to its endpoints
+type rpcPool struct {
+	chainId          int
+	endpoints        []*rpcEndpoint
+	client           *http.Client
+	timeout          time.Duration
+	failureThreshold int
+	circuitOpen      time.Duration
+	maxBlockLag      uint64
+	limiter          *rpcLimiter // budget of the chain
+	queueTimeout     time.Duration
+	now              func() time.Time
+	rand             func() float64
+}
+
+func newRPCPool(chainId int, endpoints []RPCEndpoint) *rpcPool {
+	pool := &rpcPool{
+		chainId:          chainId,
+		client:           &http.Client{},
+		timeout:          secondsOr(config.RPCTimeoutSeconds, defaultRPCTimeout),
+		failureThreshold: config.RPCFailureThreshold,
+		circuitOpen:      secondsOr(config.RPCCircuitOpenSeconds, defaultRPCCircuitOpen),
+		maxBlockLag:      uint64(config.RPCMaxBlockLag),
+		queueTimeout:     time.Duration(config.RPCQueueMillis) * time.Millisecond,
+		now:              time.Now,
+		rand:             rand.Float64,
+	}
+	if pool.failureThreshold <= 0 {
+		pool.failureThreshold = defaultRPCFailureThreshold
+	}
+	if pool.maxBlockLag == 0 {
+		pool.maxBlockLag = defaultRPCMaxBlockLag
+	}
+	if pool.queueTimeout <= 0 {
+		pool.queueTimeout = defaultRPCQueueTimeout
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Weight <= 0 {
+			endpoint.Weight = 1
+		}
+		pool.endpoints = append(pool.endpoints, &rpcEndpoint{
+			RPCEndpoint: endpoint,
+			limiter:     newRPCLimiter(endpoint.RateLimit, endpoint.Burst, endpoint.MaxInFlight),
+			healthy:     true,
+		})
+	}
+	return pool
+}
+
+// chainRPCEndpoints returns the RPC endpoints of a chain config: RPCs, and the RPC of the older
+// configs
+func chainRPCEndpoints(chainConfig ChainConfig) []RPCEndpoint {
+	endpoints := append([]RPCEndpoint{}, chainConfig.RPCs...)
+	if chainConfig.RPC != "" {
+		endpoints = append(endpoints, RPCEndpoint{URL: chainConfig.RPC})
+	}
+	return endpoints
+}
+
+// available tells if an endpoint can be used: healthy, and not left aside after failures
+func (e *rpcEndpoint) available(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.healthy && !e.quarantined && !now.Before(e.circuitOpenUntil)
+}
+
+func (e *rpcEndpoint) isQuarantined() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.quarantined
+}
+
+func (e *rpcEndpoint) recordSuccess() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests++
+	e.consecutiveFailures = 0
+}
+
+// recordFailure counts a failed request, and opens the circuit after threshold consecutive
+// failures. After the circuit is open, a single failure opens it again.
+func (e *rpcEndpoint) recordFailure(err error, now time.Time, threshold int, circuitOpen time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests++
+	e.failures++
+	e.consecutiveFailures++
+	e.lastError = err.Error()
+	if e.consecutiveFailures >= threshold {
+		if e.circuitOpenUntil.IsZero() || !now.Before(e.circuitOpenUntil) {
+			log.Warnf("RPC endpoint %v is left aside for %v: %v", redactRPCURL(e.URL), circuitOpen, err)
+		}
+		e.circuitOpenUntil = now.Add(circuitOpen)
+		e.consecutiveFailures = threshold - 1
+	}
+}
+
+// candidates returns the endpoints in the order they should be tried: the available ones by
+// priority, shuffled by weight within a priority, then the unavailable ones as a last resort.
+// The quarantined endpoints are left out.
+func (p *rpcPool) candidates() []*rpcEndpoint {
+	now := p.now()
+	type candidate struct {
+		endpoint  *rpcEndpoint
+		available bool
+		key       float64
+	}
+	candidates := make([]candidate, 0, len(p.endpoints))
+	for _, endpoint := range p.endpoints {
+		if endpoint.isQuarantined() {
+			continue
+		}
+		// Weighted random order: the endpoints with the highest rand^(1/weight) first
+		key := math.Pow(p.rand(), 1/float64(endpoint.Weight))
+		candidates = append(candidates, candidate{endpoint, endpoint.available(now), key})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.available != b.available {
+			return a.available
+		}
+		if a.endpoint.Priority != b.endpoint.Priority {
+			return a.endpoint.Priority < b.endpoint.Priority
+		}
+		return a.key > b.key
+	})
+	endpoints := make([]*rpcEndpoint, len(candidates))
+	for i, c := range candidates {
+		endpoints[i] = c.endpoint
+	}
+	return endpoints
+}
+
+// ServeHTTP forwards a JSON-RPC request to the endpoints of the chain, until one answers. The
+// request waits for the budget of the chain, and the endpoints over their own budget are tried last.
+func (p *rpcPool) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// The RPC calls are counted and traced as part of their fetch, and given up with it
+	if fetchCtx := fetchSlotContext(req); fetchCtx != nil {
+		if err := fetchCtx.Err(); err != nil {
+			http.Error(w, fmt.Sprintf("the fetch is over: %v", err), http.StatusGatewayTimeout)
+			return
+		}
+		if info, ok := fetchCtx.Value(requestInfoKey{}).(*requestInfo); ok {
+			atomic.AddUint64(&info.rpcCalls, 1)
+		}
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-fetchCtx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		if s := spanFromContext(fetchCtx); s != nil {
+			req = req.WithContext(context.WithValue(ctx, spanKey{}, s))
+		} else {
+			req = req.WithContext(ctx)
+		}
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxRPCRequestBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deadline := time.Now().Add(p.queueTimeout)
+	release, retryAfter, ok := p.limiter.acquire(req.Context(), p.queueTimeout)
+	if !ok {
+		p.throttle(w, req, retryAfter)
+		return
+	}
+	defer release()
+
+	var throttled []*rpcEndpoint
+	for _, endpoint := range p.candidates() {
+		release, _, ok := endpoint.limiter.acquire(req.Context(), 0)
+		if !ok {
+			throttled = append(throttled, endpoint)
+			continue
+		}
+		done := p.tryEndpoint(w, req, endpoint, body)
+		release()
+		if done {
+			return
+		}
+	}
+	// Only the endpoints over their budget are left: wait for them
+	overBudget := false
+	for _, endpoint := range throttled {
+		release, wait, ok := endpoint.limiter.acquire(req.Context(), time.Until(deadline))
+		if !ok {
+			if !overBudget || wait < retryAfter {
+				retryAfter = wait
+			}
+			overBudget = true
+			continue
+		}
+		done := p.tryEndpoint(w, req, endpoint, body)
+		release()
+		if done {
+			return
+		}
+	}
+	if overBudget {
+		p.throttle(w, req, retryAfter)
+		return
+	}
+	http.Error(w, fmt.Sprintf("no RPC endpoint of chain %v is available", p.chainId), http.StatusBadGateway)
+}
+
+// tryEndpoint forwards a JSON-RPC request to an endpoint, and tells if it is done: answered, or
+// given up by the client
+func (p *rpcPool) tryEndpoint(w http.ResponseWriter, req *http.Request, endpoint *rpcEndpoint, body []byte) bool {
+	method, to := rpcMethod(body)
+	ctx, span := startSpan(req.Context(), "rpc "+method, spanKindClient)
+	span.set("rpc.system", "jsonrpc")
+	span.set("rpc.method", method)
+	span.set("rpc.to", to)
+	span.set("rpc.endpoint", redactRPCURL(endpoint.URL))
+	span.set("web3.chain", strconv.Itoa(p.chainId))
+	status, contentType, respBody, err := p.forward(ctx, endpoint, body)
+	span.fail(err)
+	span.finish()
+	if err != nil {
+		if req.Context().Err() != nil {
+			// The client went away: not the fault of the endpoint
+			return true
+		}
+		log.Infof("RPC endpoint %v of chain %v failed: %v", redactRPCURL(endpoint.URL), p.chainId, err)
+		endpoint.recordFailure(err, p.now(), p.failureThreshold, p.circuitOpen)
+		return false
+	}
+	endpoint.recordSuccess()
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	_, _ = w.Write(respBody)
+	return true
+}
+
+// rpcMethod returns the method of a JSON-RPC request, and the contract called by eth_call, e.g. to
+// tell the name resolutions from the calls of the web3:// URLs. The batches are reported as such.
+func rpcMethod(body []byte) (method string, to string) {
+	var request struct {
+		Method string
+		Params []json.RawMessage
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		if len(bytes.TrimSpace(body)) > 0 && bytes.TrimSpace(body)[0] == '[' {
+			return "batch", ""
+		}
+		return "unknown", ""
+	}
+	if request.Method == "eth_call" && len(request.Params) > 0 {
+		var call struct {
+			To string
+		}
+		if json.Unmarshal(request.Params[0], &call) == nil {
+			to = call.To
+		}
+	}
+	return request.Method, to
+}
+
+// throttle answers a request over the RPC budget of the chain
+func (p *rpcPool) throttle(w http.ResponseWriter, req *http.Request, retryAfter time.Duration) {
+	if req.Context().Err() != nil {
+		return
+	}
+	err := &rpcThrottledError{chainId: p.chainId, retryAfter: retryAfter}
+	w.Header().Set("Retry-After", err.retryAfterSeconds())
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
+// forward sends a JSON-RPC request to an endpoint. Rate limiting and server errors are failures
+// of the endpoint; JSON-RPC errors (e.g. reverted calls) are valid answers.
+func (p *rpcPool) forward(ctx context.Context, endpoint *rpcEndpoint, body []byte) (int, string, []byte, error) {
+	start := time.Now()
+	status, contentType, respBody, err := p.send(ctx, endpoint, body)
+	chain, endpointLabel := strconv.Itoa(p.chainId), redactRPCURL(endpoint.URL)
+	rpcDuration.observe(time.Since(start).Seconds(), chain, endpointLabel)
+	if err != nil && ctx.Err() == nil {
+		rpcErrors.inc(chain, endpointLabel)
+	}
+	return status, contentType, respBody, err
+}
+
+func (p *rpcPool) send(ctx context.Context, endpoint *rpcEndpoint, body []byte) (int, string, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	injectTraceparent(ctx, req)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return 0, "", nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, resp.Header.Get("Content-Type"), respBody, nil
+}
+
+// call sends a JSON-RPC request without parameters to an endpoint, and returns its hex quantity
+// result, e.g. for eth_chainId and eth_blockNumber
+func (p *rpcPool) call(ctx context.Context, endpoint *rpcEndpoint, method string) (uint64, error) {
+	body := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":%q,"params":[]}`, method)
+	_, _, respBody, err := p.forward(ctx, endpoint, []byte(body))
+	if err != nil {
+		return 0, err
+	}
+	var resp struct {
+		Result string `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return 0, fmt.Errorf("%v: invalid response: %v", method, err)
+	}
+	if resp.Error != nil {
+		return 0, fmt.Errorf("%v: %v", method, resp.Error.Message)
+	}
+	value, err := strconv.ParseUint(strings.TrimPrefix(resp.Result, "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%v: invalid result %q", method, resp.Result)
+	}
+	return value, nil
+}
+
+// checkHealth probes each endpoint with eth_chainId and eth_blockNumber. The endpoints failing,
+// or lagging behind the most advanced endpoint of the chain by more than maxBlockLag, are unhealthy.
+// The endpoints serving another chain are quarantined.
+func (p *rpcPool) checkHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	errs := make([]error, len(p.endpoints))
+	chainIds := make([]uint64, len(p.endpoints))
+	blocks := make([]uint64, len(p.endpoints))
+	for i, endpoint := range p.endpoints {
+		wg.Add(1)
+		go func(i int, endpoint *rpcEndpoint) {
+			defer wg.Done()
+			chainIds[i], errs[i] = p.call(ctx, endpoint, "eth_chainId")
+			if errs[i] != nil {
+				return
+			}
+			if chainIds[i] != uint64(p.chainId) {
+				errs[i] = fmt.Errorf("serves chain %d instead of %d", chainIds[i], p.chainId)
+				return
+			}
+			blocks[i], errs[i] = p.call(ctx, endpoint, "eth_blockNumber")
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	bestBlock := uint64(0)
+	for i := range p.endpoints {
+		if errs[i] == nil && blocks[i] > bestBlock {
+			bestBlock = blocks[i]
+		}
+	}
+	now := p.now()
+	for i, endpoint := range p.endpoints {
+		err := errs[i]
+		if err == nil && bestBlock-blocks[i] > p.maxBlockLag {
+			err = fmt.Errorf("%d blocks behind", bestBlock-blocks[i])
+		}
+		mismatch := chainIds[i] != 0 && chainIds[i] != uint64(p.chainId)
+		endpoint.mu.Lock()
+		if mismatch && !endpoint.quarantined {
+			log.Errorf("RPC endpoint %v of chain %v is quarantined: it %v", redactRPCURL(endpoint.URL), p.chainId, err)
+		} else if !mismatch && endpoint.quarantined && chainIds[i] != 0 {
+			log.Infof("RPC endpoint %v of chain %v serves the right chain again", redactRPCURL(endpoint.URL), p.chainId)
+		}
+		if chainIds[i] != 0 {
+			endpoint.quarantined = mismatch
+			endpoint.servedChainId = chainIds[i]
+		}
+		if endpoint.healthy != (err == nil) && !mismatch {
+			if err != nil {
+				log.Warnf("RPC endpoint %v of chain %v is unhealthy: %v", redactRPCURL(endpoint.URL), p.chainId, err)
+			} else {
+				log.Infof("RPC endpoint %v of chain %v is healthy again", redactRPCURL(endpoint.URL), p.chainId)
+			}
+		}
+		endpoint.healthy = err == nil
+		endpoint.lastCheck = now
+		if errs[i] == nil {
+			endpoint.latestBlock = blocks[i]
+		}
+		if err != nil {
+			endpoint.lastError = err.Error()
+		}
+		endpoint.mu.Unlock()
+	}
+}
+
+// healthLoop probes the endpoints until ctx is done
+func (p *rpcPool) healthLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		p.checkHealth(ctx)
+	}
+}
+
+// usable tells if the chain has an endpoint which can be used
+func (p *rpcPool) usable() bool {
+	now := p.now()
+	for _, endpoint := range p.endpoints {
+		if endpoint.available(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// quarantined returns the redacted URLs of the quarantined endpoints, with the chain they serve
+func (p *rpcPool) quarantined() []string {
+	quarantined := []string{}
+	for _, endpoint := range p.endpoints {
+		endpoint.mu.Lock()
+		if endpoint.quarantined {
+			quarantined = append(quarantined, fmt.Sprintf("%v (chain %d)", redactRPCURL(endpoint.URL), endpoint.servedChainId))
+		}
+		endpoint.mu.Unlock()
+	}
+	return quarantined
+}
+
+// rpcEndpointStatus is the status of an RPC endpoint, shown on the admin page
+type rpcEndpointStatus struct {
+	URL         string    `json:"url"`
+	Priority    int       `json:"priority"`
+	Weight      int       `json:"weight"`
+	Healthy     bool      `json:"healthy"`
+	Quarantined bool      `json:"quarantined"`
+	ChainId     uint64    `json:"chainId,omitempty"` // as returned by eth_chainId
+	CircuitOpen bool      `json:"circuitOpen"`
+	LatestBlock uint64    `json:"latestBlock"`
+	BlockLag    uint64    `json:"blockLag"`
+	Requests    uint64    `json:"requests"`
+	Failures    uint64    `json:"failures"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastCheck   time.Time `json:"lastCheck"`
+
+	Throttling *rpcLimiterStats `json:"throttling,omitempty"` // if the endpoint has a budget
+}
+
+// getStatus returns the status of the endpoints of the pool
+func (p *rpcPool) getStatus() []rpcEndpointStatus {
+	now := p.now()
+	statuses := make([]rpcEndpointStatus, 0, len(p.endpoints))
+	bestBlock := uint64(0)
+	for _, endpoint := range p.endpoints {
+		endpoint.mu.Lock()
+		statuses = append(statuses, rpcEndpointStatus{
+			URL:         redactRPCURL(endpoint.URL),
+			Priority:    endpoint.Priority,
+			Weight:      endpoint.Weight,
+			Healthy:     endpoint.healthy,
+			Quarantined: endpoint.quarantined,
+			ChainId:     endpoint.servedChainId,
+			CircuitOpen: now.Before(endpoint.circuitOpenUntil),
+			LatestBlock: endpoint.latestBlock,
+			Requests:    endpoint.requests,
+			Failures:    endpoint.failures,
+			LastError:   endpoint.lastError,
+			LastCheck:   endpoint.lastCheck,
+			Throttling:  endpoint.limiter.getStats(),
+		})
+		if endpoint.latestBlock > bestBlock {
+			bestBlock = endpoint.latestBlock
+		}
+		endpoint.mu.Unlock()
+	}
+	for i := range statuses {
+		if statuses[i].LatestBlock > 0 {
+			statuses[i].BlockLag = bestBlock - statuses[i].LatestBlock
+		}
+	}
+	return statuses
+}
+
+// redactRPCURL removes the path and query of an RPC URL, which often hold API keys
+// e.g. https://mainnet.infura.io/v3/<key> -> https://mainnet.infura.io/...
+func redactRPCURL(rpcUrl string) string {
+	u, err := url.Parse(rpcUrl)
+	if err != nil || u.Host == "" {
+		return "(invalid URL)"
+	}
+	redacted := u.Scheme + "://" + u.Host
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" {
+		redacted += "/..."
+	}
+	return redacted
+}
+
+var (
+	rpcPools = map[int]*rpcPool{}
+
+	rpcProxy      *http.Server
+	stopRPCHealth = func() {}
+)
+
+// initRPCPools starts the local proxy to the RPC endpoints of the chains, and the health probes
+// of the endpoints. It returns the URLs of the proxy of each chain.
+func initRPCPools() map[int]string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Cannot start the RPC proxy: %v\n", err)
+	}
+	mux := http.NewServeMux()
+	proxyUrls := map[int]string{}
+	interval := secondsOr(config.RPCHealthCheckSeconds, defaultRPCHealthCheck)
+	for _, chainConfig := range config.ChainConfigs {
+		chainId := chainConfig.ChainID
+		endpoints := chainRPCEndpoints(chainConfig)
+		if len(endpoints) == 0 {
+			log.Fatalf("No RPC for chain %v\n", chainId)
+		}
+		pool := newRPCPool(chainId, endpoints)
+		pool.limiter = newRPCLimiter(chainConfig.RPCRateLimit, chainConfig.RPCBurst, chainConfig.RPCMaxInFlight)
+		rpcPools[chainId] = pool
+		path := fmt.Sprintf("/chain/%d", chainId)
+		mux.Handle(path, pool)
+		// The calls of the fetches, see fetchSlot
+		mux.Handle(path+"/", pool)
+		proxyUrls[chainId] = "http://" + listener.Addr().String() + path
+	}
+
+	// Check that each endpoint serves its chain before serving requests
+	validateRPCPools()
+	if config.RPCHealthCheckSeconds >= 0 {
+		var ctx context.Context
+		ctx, stopRPCHealth = context.WithCancel(context.Background())
+		for _, pool := range rpcPools {
+			go pool.healthLoop(ctx, interval)
+		}
+	}
+	rpcProxy = &http.Server{Handler: mux}
+	go func() {
+		if err := rpcProxy.Serve(listener); err != http.ErrServerClosed {
+			log.Fatalf("RPC proxy stopped: %v\n", err)
+		}
+	}()
+	return proxyUrls
+}
+
+// closeRPCPools stops the health probes and the RPC proxy, once the last request is served, and
+// closes the connections to the endpoints
+func closeRPCPools() {
+	stopRPCHealth()
+	if rpcProxy != nil {
+		if err := rpcProxy.Close(); err != nil {
+			log.Errorf("Cannot stop the RPC proxy: %v\n", err)
+		}
+	}
+	for _, pool := range rpcPools {
+		pool.client.CloseIdleConnections()
+	}
+}
+
+// validateRPCChainIdMismatch checks the RPCChainIdMismatch setting
+func validateRPCChainIdMismatch() error {
+	switch config.RPCChainIdMismatch {
+	case "", rpcChainIdMismatchQuarantine, rpcChainIdMismatchRefuse:
+		return nil
+	}
+	return fmt.Errorf("unknown RPCChainIdMismatch %v, expected %v or %v", config.RPCChainIdMismatch, rpcChainIdMismatchQuarantine, rpcChainIdMismatchRefuse)
+}
+
+// validateRPCPools probes the endpoints of all chains, and refuses to start if one serves another
+// chain, unless they are only quarantined
+func validateRPCPools() {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcStartupCheckTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, pool := range rpcPools {
+		wg.Add(1)
+		go func(pool *rpcPool) {
+			defer wg.Done()
+			pool.checkHealth(ctx)
+		}(pool)
+	}
+	wg.Wait()
+	for chainId, pool := range rpcPools {
+		quarantined := pool.quarantined()
+		if len(quarantined) > 0 && config.RPCChainIdMismatch == rpcChainIdMismatchRefuse {
+			log.Fatalf("RPC endpoints of chain %v serve another chain: %v\n", chainId, strings.Join(quarantined, ", "))
+		}
+	}
+}
+
+// handleRPCStatus serves the status of the RPC endpoints of each chain
+func handleRPCStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	status := map[string][]rpcEndpointStatus{}
+	for chainId, pool := range rpcPools {
+		status[strconv.Itoa(chainId)] = pool.getStatus()
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Errorf("Cannot write RPC status: %v\n", err)
+	}
+}
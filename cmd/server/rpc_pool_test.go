@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rpcStandIn is a JSON-RPC server answering eth_chainId, eth_blockNumber and eth_call
+type rpcStandIn struct {
+	mu       sync.Mutex
+	chainId  uint64
+	block    uint64
+	status   int // if set, the HTTP status of the answers
+	requests int
+}
+
+func newRPCStandIn(t *testing.T, chainId uint64, block uint64) (*rpcStandIn, *httptest.Server) {
+	standIn := &rpcStandIn{chainId: chainId, block: block}
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+	return standIn, server
+}
+
+func (s *rpcStandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	var rpcReq struct {
+		Id     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+	}
+	_ = json.NewDecoder(req.Body).Decode(&rpcReq)
+	result := ""
+	switch rpcReq.Method {
+	case "eth_chainId":
+		result = fmt.Sprintf("0x%x", s.chainId)
+	case "eth_blockNumber":
+		result = fmt.Sprintf("0x%x", s.block)
+	default:
+		result = "0x"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":%q}`, rpcReq.Id, result)
+}
+
+func (s *rpcStandIn) set(status int, block uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.block = status, block
+}
+
+func (s *rpcStandIn) getRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func rpcPost(pool *rpcPool) (int, string) {
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, httptest.NewRequest("POST", "/chain/1", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`)))
+	body, _ := io.ReadAll(w.Body)
+	return w.Code, string(body)
+}
+
+func TestRPCPoolFailover(t *testing.T) {
+	primary, primaryServer := newRPCStandIn(t, 1, 100)
+	backup, backupServer := newRPCStandIn(t, 1, 100)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	pool := newRPCPool(1, []RPCEndpoint{{URL: backupServer.URL, Priority: 1}, {URL: primaryServer.URL}})
+	pool.now = func() time.Time { return now }
+
+	// The endpoint with the lowest priority is used
+	code, _ := rpcPost(pool)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, primary.getRequests())
+	assert.Equal(t, 0, backup.getRequests())
+
+	// Failover on errors, until the circuit of the primary endpoint opens
+	primary.set(http.StatusServiceUnavailable, 100)
+	for i := 0; i < 3; i++ {
+		code, _ = rpcPost(pool)
+		assert.Equal(t, http.StatusOK, code)
+	}
+	assert.Equal(t, 4, primary.getRequests())
+	assert.Equal(t, 3, backup.getRequests())
+	code, _ = rpcPost(pool)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 4, primary.getRequests())
+	assert.True(t, pool.getStatus()[1].CircuitOpen)
+
+	// Once the circuit is closed, the primary endpoint is tried again
+	now = now.Add(31 * time.Second)
+	primary.set(0, 100)
+	_, _ = rpcPost(pool)
+	assert.Equal(t, 5, primary.getRequests())
+	assert.False(t, pool.getStatus()[1].CircuitOpen)
+
+	// No endpoint answers
+	primary.set(http.StatusTooManyRequests, 100)
+	backup.set(http.StatusBadGateway, 100)
+	code, _ = rpcPost(pool)
+	assert.Equal(t, http.StatusBadGateway, code)
+}
+
+func TestRPCPoolHealth(t *testing.T) {
+	upToDate, upToDateServer := newRPCStandIn(t, 1, 1000)
+	lagging, laggingServer := newRPCStandIn(t, 1, 980)
+	pool := newRPCPool(1, []RPCEndpoint{{URL: laggingServer.URL}, {URL: upToDateServer.URL, Priority: 1}})
+
+	pool.checkHealth(context.Background())
+	status := pool.getStatus()
+	assert.False(t, status[0].Healthy)
+	assert.Equal(t, uint64(20), status[0].BlockLag)
+	assert.True(t, status[1].Healthy)
+
+	// The unhealthy endpoint is used last, despite its priority
+	requests := lagging.getRequests()
+	_, _ = rpcPost(pool)
+	assert.Equal(t, requests, lagging.getRequests())
+
+	// Recovery, and failure of the probes
+	lagging.set(0, 1000)
+	upToDate.set(http.StatusInternalServerError, 1000)
+	pool.checkHealth(context.Background())
+	status = pool.getStatus()
+	assert.True(t, status[0].Healthy)
+	assert.False(t, status[1].Healthy)
+	assert.Equal(t, "HTTP 500", status[1].LastError)
+}
+
+func TestRPCPoolWeights(t *testing.T) {
+	pool := newRPCPool(1, []RPCEndpoint{{URL: "http://a", Weight: 3}, {URL: "http://b", Weight: 1}, {URL: "http://c", Priority: 1, Weight: 100}})
+	first := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		candidates := pool.candidates()
+		first[candidates[0].URL]++
+		// The other priorities come after
+		assert.Equal(t, "http://c", candidates[2].URL)
+	}
+	assert.InDelta(t, 3000, first["http://a"], 200)
+	assert.InDelta(t, 1000, first["http://b"], 200)
+}
+
+func TestRedactRPCURL(t *testing.T) {
+	assert.Equal(t, "https://mainnet.infura.io/...", redactRPCURL("https://mainnet.infura.io/v3/0123456789abcdef"))
+	assert.Equal(t, "https://rpc.ankr.com", redactRPCURL("https://rpc.ankr.com"))
+	assert.Equal(t, "https://andromeda.metis.io/...", redactRPCURL("https://andromeda.metis.io/?owner=1088"))
+}
+
+func TestRPCPoolChainIdMismatch(t *testing.T) {
+	goerli, goerliServer := newRPCStandIn(t, 5, 1000)
+	_, mainnetServer := newRPCStandIn(t, 1, 1000)
+	pool := newRPCPool(1, []RPCEndpoint{{URL: goerliServer.URL}, {URL: mainnetServer.URL, Priority: 1}})
+
+	pool.checkHealth(context.Background())
+	status := pool.getStatus()
+	assert.True(t, status[0].Quarantined)
+	assert.Equal(t, uint64(5), status[0].ChainId)
+	assert.Equal(t, "serves chain 5 instead of 1", status[0].LastError)
+	assert.False(t, status[1].Quarantined)
+	assert.Equal(t, []string{goerliServer.URL + " (chain 5)"}, pool.quarantined())
+
+	// Quarantined endpoints are never used, even as a last resort
+	assert.Len(t, pool.candidates(), 1)
+	requests := goerli.getRequests()
+	_, _ = rpcPost(pool)
+	assert.Equal(t, requests, goerli.getRequests())
+	assert.True(t, pool.usable())
+
+	// Fixed
+	goerli.mu.Lock()
+	goerli.chainId = 1
+	goerli.mu.Unlock()
+	pool.checkHealth(context.Background())
+	assert.False(t, pool.getStatus()[0].Quarantined)
+	assert.Empty(t, pool.quarantined())
+}
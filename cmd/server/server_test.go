@@ -24,6 +24,7 @@ func init() {
 	config.NSDefaultChains["w3q"] = 3334
 	config.DefaultChain = 3334
 
+	initCORSPolicy()
 	initWeb3protocolClient()
 }
 
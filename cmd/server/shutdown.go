@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Graceful shutdown: on SIGTERM or SIGINT, /_ready fails, and after ShutdownDelaySeconds (for the
+// load balancers to stop sending requests) the servers stop accepting connections, and the
+// requests being served (e.g. streams of large files) are drained, up to ShutdownTimeoutSeconds.
+// Then the stats, spans and access logs are flushed, and the RPC clients closed.
+
+const defaultShutdownTimeout = 30 * time.Second
+
+var (
+	servers      []*http.Server
+	serversMu    sync.Mutex
+	shuttingDown atomic.Bool
+)
+
+// serve starts a server of the gateway with its listen function, e.g. ListenAndServe, and drains
+// it on shutdown
+func serve(server *http.Server, listen func() error) {
+	serversMu.Lock()
+	servers = append(servers, server)
+	serversMu.Unlock()
+	go func() {
+		if err := listen(); err != http.ErrServerClosed {
+			log.Fatalf("Cannot start server %v: %v\n", server.Addr, err)
+		}
+	}()
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT, then shuts the gateway down
+func waitForShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	signal.Stop(signals)
+	log.Infof("Received %v, shutting down\n", sig)
+	shutdown(time.Duration(config.ShutdownDelaySeconds)*time.Second, secondsOr(config.ShutdownTimeoutSeconds, defaultShutdownTimeout))
+}
+
+// shutdown reports the gateway as not ready, and after the delay drains the servers, up to the
+// timeout, then closes the clients and flushes the sinks
+func shutdown(delay time.Duration, timeout time.Duration) {
+	shuttingDown.Store(true)
+	time.Sleep(delay)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	serversMu.Lock()
+	draining := append([]*http.Server{}, servers...)
+	serversMu.Unlock()
+	var wg sync.WaitGroup
+	for _, server := range draining {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Warnf("Server %v not drained in %v, closing its connections: %v\n", server.Addr, timeout, err)
+				_ = server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	// The requests are served: the RPC calls are done
+	closeRPCPools()
+	if err := statsSink.Close(); err != nil {
+		log.Errorf("Cannot flush the stats: %v\n", err)
+	}
+	shutdownTracing()
+	closeAccessLog()
+	log.Info("Shut down")
+}
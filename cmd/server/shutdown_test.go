@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	defer func(sink StatsSink, pools map[int]*rpcPool) {
+		statsSink, rpcPools, servers = sink, pools, nil
+		shuttingDown.Store(false)
+	}(statsSink, rpcPools)
+	rpcPools = map[int]*rpcPool{}
+	var sent []StatsEvent
+	statsSink = newAsyncStatsSink(10, func(event StatsEvent, more bool) { sent = append(sent, event) }, func() error { return nil })
+
+	// A request streaming a large file, and one which never ends
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+		_, _ = w.Write(make([]byte, 1<<20))
+		statsSink.Emit(StatsEvent{Path: "/stream"})
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &http.Server{Handler: mux}
+	servers = nil
+	serve(server, func() error { return server.Serve(listener) })
+	url := "http://" + listener.Addr().String()
+
+	streamed := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url + "/stream")
+		if !assert.NoError(t, err) {
+			streamed <- 0
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		streamed <- len(body)
+	}()
+	<-started
+
+	// The request being served is drained, then the stats are flushed
+	done := make(chan struct{})
+	go func() {
+		shutdown(0, 5*time.Second)
+		close(done)
+	}()
+	for !shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, isReady())
+	time.Sleep(50 * time.Millisecond)
+	_, err = http.Get(url + "/stream")
+	assert.Error(t, err, "no new connections")
+	close(release)
+	assert.Equal(t, 1<<20, <-streamed)
+	<-done
+	assert.Equal(t, []StatsEvent{{Path: "/stream"}}, sent)
+
+	// The requests still served at the deadline are cut
+	shuttingDown.Store(false)
+	statsSink = noopStatsSink{}
+	mux = http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-req.Context().Done()
+	})
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server = &http.Server{Handler: mux}
+	servers = nil
+	serve(server, func() error { return server.Serve(listener) })
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	start := time.Now()
+	shutdown(0, 100*time.Millisecond)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// During the delay, the gateway is not ready but still serves the requests
+	shuttingDown.Store(false)
+	mux = http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {})
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server = &http.Server{Handler: mux}
+	servers = nil
+	serve(server, func() error { return server.Serve(listener) })
+	done = make(chan struct{})
+	go func() {
+		shutdown(time.Second, time.Second)
+		close(done)
+	}()
+	for !shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, isReady())
+	resp, err := http.Get("http://" + listener.Addr().String())
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	<-done
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	log "github.com/sirupsen/logrus"
+)
+
+// StatsConfig configures where the stats of the served requests are sent
+type StatsConfig struct {
+	Sink string // influxdb, prometheus, statsd, jsonl or none; default: influxdb if -dbToken is set
+
+	InfluxURL    string // default: http://localhost:8086
+	InfluxOrg    string // default: web3q
+	InfluxBucket string // default: bucket0
+	InfluxToken  string // default: -dbToken
+
+	StatsdAddr   string // UDP address, default: 127.0.0.1:8125
+	StatsdPrefix string // default: web3url
+
+	File string // JSON lines file
+
+	QueueSize int // events waiting to be sent by the statsd and jsonl sinks; over it, they are dropped
+}
+
+// Values of the Sink setting
+const (
+	statsSinkInfluxDB   = "influxdb"
+	statsSinkPrometheus = "prometheus"
+	statsSinkStatsd     = "statsd"
+	statsSinkJSONLines  = "jsonl"
+	statsSinkNone       = "none"
+)
+
+const defaultStatsQueueSize = 10000
+
+// StatsEvent is a request served by the gateway
+type StatsEvent struct {
+	Time      time.Time `json:"time"`
+	ChainId   string    `json:"chainId"`
+	ChainName string    `json:"chain"`
+	NSType    string    `json:"nsType"`
+	Size      int       `json:"size"`
+	ClientIP  string    `json:"ip"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Homepage  bool      `json:"homepage"` // the home page of a site, on a named host
+}
+
+// StatsSink receives the stats of the served requests. Emit is called on the request path, and
+// must not block; Close flushes the pending events, after the last Emit.
+type StatsSink interface {
+	Emit(event StatsEvent)
+	Close() error
+}
+
+var statsSink StatsSink = noopStatsSink{}
+
+// noopStatsSink drops the events
+type noopStatsSink struct{}
+
+func (noopStatsSink) Emit(StatsEvent) {}
+
+func (noopStatsSink) Close() error {
+	return nil
+}
+
+// influxStatsSink writes the events to InfluxDB, in batches
+type influxStatsSink struct {
+	client   influxdb2.Client
+	writeAPI api.WriteAPI
+}
+
+func newInfluxStatsSink(url string, token string, org string, bucket string) *influxStatsSink {
+	client := influxdb2.NewClient(url, token)
+	sink := &influxStatsSink{client: client, writeAPI: client.WriteAPI(org, bucket)}
+	// Errors creates the channel, which must not race with Close
+	errors := sink.writeAPI.Errors()
+	go func() {
+		for err := range errors {
+			log.Errorln("db err", err)
+		}
+	}()
+	return sink
+}
+
+func (s *influxStatsSink) Emit(event StatsEvent) {
+	s.writeAPI.WritePoint(influxdb2.NewPointWithMeasurement("w3stats").
+		AddTag("chain", event.ChainName).
+		AddTag("type", event.NSType).
+		AddField("size", event.Size).
+		SetTime(event.Time))
+	s.writeAPI.WritePoint(influxdb2.NewPointWithMeasurement("w3stats_url").
+		AddTag("url", event.Host).
+		AddField("ip", event.ClientIP).
+		SetTime(event.Time))
+	if event.Homepage {
+		s.writeAPI.WritePoint(influxdb2.NewPointWithMeasurement("w3stats_homepage").
+			AddTag("url", event.Host).
+			AddField("ip", event.ClientIP).
+			SetTime(event.Time))
+	}
+}
+
+func (s *influxStatsSink) Close() error {
+	s.writeAPI.Flush()
+	s.client.Close()
+	return nil
+}
+
+// asyncWriteAPI is the api.WriteAPIBlocking expected by the tracer of web3protocol-go, writing
+// through the non-blocking api.WriteAPI, so that the name resolutions do not wait for InfluxDB.
+// The write errors are reported on the Errors channel of the api.WriteAPI.
+type asyncWriteAPI struct {
+	writeAPI api.WriteAPI
+}
+
+func (w asyncWriteAPI) WriteRecord(ctx context.Context, lines ...string) error {
+	for _, line := range lines {
+		w.writeAPI.WriteRecord(line)
+	}
+	return nil
+}
+
+func (w asyncWriteAPI) WritePoint(ctx context.Context, points ...*write.Point) error {
+	for _, point := range points {
+		w.writeAPI.WritePoint(point)
+	}
+	return nil
+}
+
+// EnableBatching does nothing: the writes are always batched
+func (w asyncWriteAPI) EnableBatching() {}
+
+func (w asyncWriteAPI) Flush(ctx context.Context) error {
+	w.writeAPI.Flush()
+	return nil
+}
+
+// The metrics of the prometheus sink
+var (
+	statsServed = newCounterVec("web3url_stats_served_total",
+		"Requests served, by chain name and name service", "chain", "ns")
+	statsServedBytes = newCounterVec("web3url_stats_served_bytes_total",
+		"Bytes served, by chain name and name service", "chain", "ns")
+	statsHomepageViews = newCounterVec("web3url_stats_homepage_views_total",
+		"Home pages served, by chain name", "chain")
+)
+
+// prometheusStatsSink counts the events in metrics served at /metrics
+type prometheusStatsSink struct{}
+
+func (prometheusStatsSink) Emit(event StatsEvent) {
+	statsServed.inc(event.ChainName, event.NSType)
+	statsServedBytes.add(float64(event.Size), event.ChainName, event.NSType)
+	if event.Homepage {
+		statsHomepageViews.inc(event.ChainName)
+	}
+}
+
+func (prometheusStatsSink) Close() error {
+	return nil
+}
+
+// asyncStatsSink sends the events from a queue, in the background. The events are dropped when
+// the queue is full, and once the sink is closed.
+type asyncStatsSink struct {
+	events  chan StatsEvent
+	send    func(event StatsEvent, more bool) // more: other events are waiting
+	flush   func() error
+	stop    chan struct{}
+	done    chan struct{}
+	dropped uint64
+}
+
+func newAsyncStatsSink(queueSize int, send func(StatsEvent, bool), flush func() error) *asyncStatsSink {
+	if queueSize <= 0 {
+		queueSize = defaultStatsQueueSize
+	}
+	s := &asyncStatsSink{events: make(chan StatsEvent, queueSize), send: send, flush: flush, stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		for {
+			select {
+			case event := <-s.events:
+				s.send(event, len(s.events) > 0)
+			case <-s.stop:
+				// Send the events queued before Close
+				for len(s.events) > 0 {
+					s.send(<-s.events, len(s.events) > 0)
+				}
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *asyncStatsSink) Emit(event StatsEvent) {
+	select {
+	case s.events <- event:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+func (s *asyncStatsSink) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.flush()
+}
+
+var statsdUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// newStatsdSink sends the events as StatsD counters, over UDP:
+// <prefix>.requests.<chain>.<ns>, <prefix>.bytes.<chain>.<ns> and <prefix>.homepage_views.<chain>
+func newStatsdSink(addr string, prefix string, queueSize int) (*asyncStatsSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	name := func(parts ...string) string {
+		for i, part := range parts {
+			if part == "" {
+				part = "unknown"
+			}
+			parts[i] = statsdUnsafeChars.ReplaceAllString(part, "_")
+		}
+		return prefix + "." + strings.Join(parts, ".")
+	}
+	send := func(event StatsEvent, more bool) {
+		packet := fmt.Sprintf("%s:1|c\n%s:%d|c", name("requests", event.ChainName, event.NSType), name("bytes", event.ChainName, event.NSType), event.Size)
+		if event.Homepage {
+			packet += fmt.Sprintf("\n%s:1|c", name("homepage_views", event.ChainName))
+		}
+		if _, err := conn.Write([]byte(packet)); err != nil {
+			log.Debugf("Cannot send stats: %v", err)
+		}
+	}
+	return newAsyncStatsSink(queueSize, send, conn.Close), nil
+}
+
+// newJSONLinesStatsSink appends the events to a file, one JSON object per line
+func newJSONLinesStatsSink(path string, queueSize int) (*asyncStatsSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewWriter(file)
+	encoder := json.NewEncoder(buffered)
+	send := func(event StatsEvent, more bool) {
+		if err := encoder.Encode(event); err != nil {
+			log.Errorf("Cannot write stats: %v\n", err)
+		}
+		if !more {
+			_ = buffered.Flush()
+		}
+	}
+	flush := func() error {
+		if err := buffered.Flush(); err != nil {
+			return err
+		}
+		return file.Close()
+	}
+	return newAsyncStatsSink(queueSize, send, flush), nil
+}
+
+// The events dropped by the sink, when it cannot keep up
+var _ = newMetricFunc("web3url_stats_dropped_total",
+	"Stats events dropped because the queue of the sink was full", "counter", nil,
+	func() []metricSample {
+		if s, ok := statsSink.(*asyncStatsSink); ok {
+			return []metricSample{{nil, float64(atomic.LoadUint64(&s.dropped))}}
+		}
+		return nil
+	})
+
+func validateStatsSink() error {
+	switch config.Stats.Sink {
+	case statsSinkJSONLines:
+		if config.Stats.File == "" {
+			return fmt.Errorf("no stats File for the %v sink", statsSinkJSONLines)
+		}
+		return nil
+	case "", statsSinkInfluxDB, statsSinkPrometheus, statsSinkStatsd, statsSinkNone:
+		return nil
+	}
+	return fmt.Errorf("unknown stats Sink %v, expected %v, %v, %v, %v or %v", config.Stats.Sink,
+		statsSinkInfluxDB, statsSinkPrometheus, statsSinkStatsd, statsSinkJSONLines, statsSinkNone)
+}
+
+func initStats() {
+	cfg := config.Stats
+	sink := cfg.Sink
+	if sink == "" && len(*dbToken) > 0 {
+		sink = statsSinkInfluxDB
+	}
+	switch sink {
+	case statsSinkInfluxDB:
+		token := cfg.InfluxToken
+		if token == "" {
+			token = *dbToken
+		}
+		influxSink := newInfluxStatsSink(stringOr(cfg.InfluxURL, "http://localhost:8086"), token,
+			stringOr(cfg.InfluxOrg, "web3q"), stringOr(cfg.InfluxBucket, "bucket0"))
+		web3protocolClient.DomainNameResolutionCache.SetTracer(asyncWriteAPI{influxSink.writeAPI})
+		statsSink = influxSink
+	case statsSinkPrometheus:
+		statsSink = prometheusStatsSink{}
+	case statsSinkStatsd:
+		statsdSink, err := newStatsdSink(stringOr(cfg.StatsdAddr, "127.0.0.1:8125"), stringOr(cfg.StatsdPrefix, "web3url"), cfg.QueueSize)
+		if err != nil {
+			log.Fatalf("Cannot start the stats sink: %v\n", err)
+		}
+		statsSink = statsdSink
+	case statsSinkJSONLines:
+		jsonLinesSink, err := newJSONLinesStatsSink(cfg.File, cfg.QueueSize)
+		if err != nil {
+			log.Fatalf("Cannot start the stats sink: %v\n", err)
+		}
+		statsSink = jsonLinesSink
+	}
+}
+
+func stringOr(value string, defaultValue string) string {
+	if value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// stats reports a served request to the stats sink
+func stats(returnSize int, clientIP net.IP, targetChain string, nsType, path, host string) {
+	ip := "unknown"
+	if clientIP != nil {
+		ip = clientIP.String()
+	}
+	statsSink.Emit(StatsEvent{
+		Time:      time.Now(),
+		ChainId:   targetChain,
+		ChainName: getChainById(targetChain),
+		NSType:    nsType,
+		Size:      returnSize,
+		ClientIP:  ip,
+		Host:      host,
+		Path:      path,
+		Homepage:  (path == "/" || path == "/index.html") && net.ParseIP(host) == nil,
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONLinesStatsSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.jsonl")
+	sink, err := newJSONLinesStatsSink(path, 0)
+	assert.NoError(t, err)
+	sink.Emit(StatsEvent{ChainId: "1", ChainName: "eth", NSType: "ens", Size: 42, ClientIP: "192.0.2.1", Host: "vitalik.eth.1.w3link.io", Path: "/", Homepage: true})
+	sink.Emit(StatsEvent{ChainId: "5", ChainName: "gor", Size: 7})
+	assert.NoError(t, sink.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+	var event StatsEvent
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &event))
+	assert.Equal(t, "vitalik.eth.1.w3link.io", event.Host)
+	assert.Equal(t, 42, event.Size)
+	assert.True(t, event.Homepage)
+}
+
+func TestStatsdSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+	sink, err := newStatsdSink(conn.LocalAddr().String(), "web3url", 0)
+	assert.NoError(t, err)
+	sink.Emit(StatsEvent{ChainName: "arb-nova", NSType: "", Size: 42, Homepage: true})
+
+	buf := make([]byte, 1500)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "web3url.requests.arb-nova.unknown:1|c\nweb3url.bytes.arb-nova.unknown:42|c\nweb3url.homepage_views.arb-nova:1|c", string(buf[:n]))
+	assert.NoError(t, sink.Close())
+}
+
+func TestAsyncStatsSinkDrops(t *testing.T) {
+	unblock := make(chan struct{})
+	sent := 0
+	sink := newAsyncStatsSink(2, func(StatsEvent, bool) {
+		<-unblock
+		sent++
+	}, func() error { return nil })
+
+	// One event is being sent, two are waiting, the others are dropped without blocking
+	for i := 0; i < 10; i++ {
+		sink.Emit(StatsEvent{})
+		time.Sleep(time.Millisecond)
+	}
+	close(unblock)
+	assert.NoError(t, sink.Close())
+	assert.Equal(t, 3, sent)
+	assert.Equal(t, uint64(7), atomic.LoadUint64(&sink.dropped))
+}
+
+func TestAsyncWriteAPI(t *testing.T) {
+	release := make(chan struct{})
+	written := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		body, _ := io.ReadAll(req.Body)
+		written <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink := newInfluxStatsSink(server.URL, "token", "web3q", "bucket0")
+	var tracer api.WriteAPIBlocking = asyncWriteAPI{sink.writeAPI}
+	// Does not wait for InfluxDB
+	assert.NoError(t, tracer.WriteRecord(context.Background(), "w3ns,name=quark.w3q hit=1"))
+	close(release)
+	assert.NoError(t, sink.Close())
+	assert.Contains(t, <-written, "w3ns,name=quark.w3q hit=1")
+}
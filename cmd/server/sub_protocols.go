@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/web3-protocol/web3protocol-go"
 )
@@ -20,9 +22,21 @@ func handleOrdinals(w http.ResponseWriter, req *http.Request, path string) {
 		respondWithErrorPage(w, &web3protocol.ErrorWithHttpCode{http.StatusBadRequest, "invalid ordinals query"})
 		return
 	}
-	ocontent, otype, oerr := getInscription(temp[2])
+	start := time.Now()
+	ctx, span := startSpan(req.Context(), "getInscription", spanKindClient)
+	span.set("ordinals.id", temp[2])
+	ocontent, otype, oerr := getInscription(ctx, temp[2])
+	span.fail(oerr)
+	span.finish()
+	result := "ok"
 	if oerr != nil {
-		respondWithErrorPage(w, &web3protocol.ErrorWithHttpCode{http.StatusBadRequest, oerr.Error()})
+		result = "error"
+	}
+	ordinalsDuration.observe(time.Since(start).Seconds(), result)
+	info := getRequestInfo(req)
+	info.chain, info.nsType = "Bitcoin", "ordinals"
+	if oerr != nil {
+		respondWithErrorPage(w, asTimeout(req.Context(), &web3protocol.ErrorWithHttpCode{http.StatusBadRequest, oerr.Error()}, "the ordinals API"))
 		return
 	}
 	if otype != "" {
@@ -34,14 +48,17 @@ func handleOrdinals(w http.ResponseWriter, req *http.Request, path string) {
 		return
 	}
 
-	if len(*dbToken) > 0 {
-		stats(len(ocontent), req.RemoteAddr, "Bitcoin", "ordinals", path, req.Host)
-	}
+	stats(len(ocontent), clientIP(req), "Bitcoin", "ordinals", path, req.Host)
 }
 
-func getInscription(idOrNumber string) ([]byte, string, error) {
+func getInscription(ctx context.Context, idOrNumber string) ([]byte, string, error) {
 	url := fmt.Sprintf("https://api.hiro.so/ordinals/v1/inscriptions/%s/content", idOrNumber)
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	injectTraceparent(ctx, req)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, "", err
 	}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Timeouts: the servers bound how long a client may take to send its request and keep an idle
+// connection, and each request has a deadline to get the response of its upstream (web3:// fetch,
+// ordinals API), past which it is answered with 504. The bodies are streamed without deadline,
+// unless WriteTimeoutSeconds is set, but each read of a web3:// body must complete within the
+// request timeout.
+
+// Defaults of the timeouts
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultRequestTimeout    = 30 * time.Second
+)
+
+// setServerTimeouts sets the configured timeouts of a server of the gateway
+func setServerTimeouts(server *http.Server) *http.Server {
+	server.ReadHeaderTimeout = secondsOr(config.ReadHeaderTimeoutSeconds, defaultReadHeaderTimeout)
+	server.ReadTimeout = secondsOr(config.ReadTimeoutSeconds, defaultReadTimeout)
+	server.WriteTimeout = time.Duration(config.WriteTimeoutSeconds) * time.Second
+	server.IdleTimeout = secondsOr(config.IdleTimeoutSeconds, defaultIdleTimeout)
+	return server
+}
+
+// requestTimeout returns how long a request may wait for its upstream
+func requestTimeout() time.Duration {
+	return secondsOr(config.RequestTimeoutSeconds, defaultRequestTimeout)
+}
+
+// upstreamTimeoutError is the error of a request whose upstream did not answer before the deadline
+type upstreamTimeoutError struct {
+	upstream string // e.g. a web3:// URL
+	timeout  time.Duration
+}
+
+func (e *upstreamTimeoutError) Error() string {
+	return fmt.Sprintf("%v did not answer within %v", e.upstream, e.timeout)
+}
+
+// asTimeout returns the timeout error of a request past its deadline, or else err
+func asTimeout(ctx context.Context, err error, upstream string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &upstreamTimeoutError{upstream: upstream, timeout: requestTimeout()}
+	}
+	return err
+}
+
+// fetchUntilDone returns the response of fetch, or the error of ctx if it is done first. fetch
+// cannot be interrupted (web3protocol-go takes no context): it goes on in the background until its
+// next RPC call, which the RPC proxy refuses past the deadline (see fetchSlot), and its late
+// response is discarded.
+func fetchUntilDone(ctx context.Context, fetch func() (*web3Response, error)) (*web3Response, error) {
+	type result struct {
+		resp *web3Response
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := fetch()
+		results <- result{resp, err}
+	}()
+	select {
+	case r := <-results:
+		return r.resp, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-results; r.err == nil {
+				_ = r.resp.body.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
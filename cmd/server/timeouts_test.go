@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type closeRecorder struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestFetchUntilDone(t *testing.T) {
+	// Answered in time
+	resp, err := fetchUntilDone(context.Background(), func() (*web3Response, error) {
+		return &web3Response{httpCode: http.StatusOK}, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.httpCode)
+
+	// Past the deadline: the late response is discarded
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	release := make(chan struct{})
+	body := &closeRecorder{Reader: strings.NewReader("late"), closed: make(chan struct{})}
+	_, err = fetchUntilDone(ctx, func() (*web3Response, error) {
+		<-release
+		return &web3Response{httpCode: http.StatusOK, body: body}, nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	close(release)
+	select {
+	case <-body.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the late body is not closed")
+	}
+
+	timeoutErr := asTimeout(ctx, err, "web3://vitalik.eth/")
+	var upstreamTimeout *upstreamTimeoutError
+	assert.True(t, errors.As(timeoutErr, &upstreamTimeout))
+	assert.Equal(t, "web3://vitalik.eth/ did not answer within 30s", timeoutErr.Error())
+
+	// The other errors are kept
+	other := errors.New("execution reverted")
+	assert.Equal(t, other, asTimeout(context.Background(), other, "web3://vitalik.eth/"))
+}
+
+func TestSharedFetchOutlivesItsRequest(t *testing.T) {
+	defer func(fetch func(context.Context, string, string) (*web3Response, error)) { fetchUpstream = fetch }(fetchUpstream)
+	defer func(coalesce bool) { config.CoalesceFetches = coalesce }(config.CoalesceFetches)
+	config.CoalesceFetches = true
+	started := make(chan context.Context, 1)
+	release := make(chan struct{})
+	fetchUpstream = func(ctx context.Context, web3Url string, key string) (*web3Response, error) {
+		started <- ctx
+		<-release
+		return &web3Response{httpCode: http.StatusOK, header: http.Header{}, body: io.NopCloser(strings.NewReader("shared"))}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := fetchWeb3Response("web3://vitalik.eth/", httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		firstErr <- err
+	}()
+	fetchCtx := <-started
+	coalesced := inflightFetches.getStats().Coalesced
+	second := make(chan *web3Response, 1)
+	go func() {
+		resp, err := fetchWeb3Response("web3://vitalik.eth/", httptest.NewRequest("GET", "/", nil))
+		assert.NoError(t, err)
+		second <- resp
+	}()
+	for inflightFetches.getStats().Coalesced == coalesced {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The request which started the fetch goes away, the other one still gets the response
+	cancel()
+	assert.ErrorIs(t, <-firstErr, context.Canceled)
+	assert.NoError(t, fetchCtx.Err())
+	close(release)
+	resp := <-second
+	data, err := io.ReadAll(resp.body)
+	assert.NoError(t, err)
+	assert.Equal(t, "shared", string(data))
+	assert.NoError(t, resp.body.Close())
+}
+
+func TestSetServerTimeouts(t *testing.T) {
+	defer func(readHeader, write int) {
+		config.ReadHeaderTimeoutSeconds, config.WriteTimeoutSeconds = readHeader, write
+	}(config.ReadHeaderTimeoutSeconds, config.WriteTimeoutSeconds)
+	config.ReadHeaderTimeoutSeconds, config.WriteTimeoutSeconds = 5, 0
+
+	server := setServerTimeouts(&http.Server{})
+	assert.Equal(t, 5*time.Second, server.ReadHeaderTimeout)
+	assert.Equal(t, defaultReadTimeout, server.ReadTimeout)
+	assert.Equal(t, time.Duration(0), server.WriteTimeout, "the bodies are streamed without deadline")
+	assert.Equal(t, defaultIdleTimeout, server.IdleTimeout)
+}
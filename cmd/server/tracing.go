@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tracing of the requests, compatible with OpenTelemetry: the trace context is taken from and
+// passed on with the W3C traceparent header (https://www.w3.org/TR/trace-context/), and the spans
+// are exported with OTLP over HTTP, in its JSON encoding, or printed on stdout for debugging.
+
+// TracingConfig configures the tracing of the requests
+type TracingConfig struct {
+	Exporter     string            // otlp, stdout or none (default)
+	OTLPEndpoint string            // default: http://localhost:4318/v1/traces
+	OTLPHeaders  map[string]string // e.g. the API key of the collector
+	ServiceName  string            // default: web3url-gateway
+	SampleRate   float64           // share of the traces started by the gateway, default 1; the sampling of the incoming traces is kept
+}
+
+// Values of the Exporter setting
+const (
+	tracingExporterOTLP   = "otlp"
+	tracingExporterStdout = "stdout"
+	tracingExporterNone   = "none"
+)
+
+const (
+	defaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+	spanBatchSize       = 512
+	spanExportInterval  = 5 * time.Second
+	spanQueueSize       = 8192
+)
+
+// Kinds of span, as in OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// spanContext identifies a span, and tells if its trace is sampled
+type spanContext struct {
+	traceId [16]byte
+	spanId  [8]byte
+	sampled bool
+}
+
+// traceparent returns the traceparent header of the span
+func (sc spanContext) traceparent() string {
+	flags := 0
+	if sc.sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", sc.traceId, sc.spanId, flags)
+}
+
+// parseTraceparent parses a traceparent header, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(header string) (spanContext, bool) {
+	var sc spanContext
+	if len(header) < 55 || header[2] != '-' || header[35] != '-' || header[52] != '-' || header[:2] == "ff" {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceId[:], []byte(header[3:35])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanId[:], []byte(header[36:52])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(header[53:55], 16, 8)
+	if err != nil || sc.traceId == [16]byte{} || sc.spanId == [8]byte{} {
+		return sc, false
+	}
+	sc.sampled = flags&1 == 1
+	return sc, true
+}
+
+// span is a timed operation of a trace
+type span struct {
+	spanContext
+	parentId [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes [][2]string
+	err        string
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the current span of a context, or nil
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startSpan starts a span, child of the current span of the context, or else of the remote parent
+// if any, or else the root of a new trace. It returns nil if the tracing is disabled.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if spanExporter == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now()}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceId, s.parentId, s.sampled = parent.traceId, parent.spanId, parent.sampled
+	} else if remote, ok := ctx.Value(remoteSpanKey{}).(spanContext); ok {
+		s.traceId, s.parentId, s.sampled = remote.traceId, remote.spanId, remote.sampled
+	} else {
+		_, _ = rand.Read(s.traceId[:])
+		rate := config.Tracing.SampleRate
+		s.sampled = rate <= 0 || rate >= 1 || mathrand.Float64() < rate
+	}
+	_, _ = rand.Read(s.spanId[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+type remoteSpanKey struct{}
+
+// startServerSpan starts the span of a request served by the gateway, continuing the trace of
+// its traceparent header if any
+func startServerSpan(req *http.Request, name string) (context.Context, *span) {
+	ctx := req.Context()
+	if remote, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+		ctx = context.WithValue(ctx, remoteSpanKey{}, remote)
+	}
+	return startSpan(ctx, name, spanKindServer)
+}
+
+// set sets an attribute of the span; the empty values are left out
+func (s *span) set(key string, value string) {
+	if s == nil || value == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, [2]string{key, value})
+}
+
+// fail records the error of the operation, if any
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// finish ends the span, and queues it for export if its trace is sampled
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sampled {
+		spanExporter.enqueue(s)
+	}
+}
+
+// injectTraceparent passes the trace context of a context on to an outbound request
+func injectTraceparent(ctx context.Context, req *http.Request) {
+	if s := spanFromContext(ctx); s != nil {
+		req.Header.Set("traceparent", s.traceparent())
+	}
+}
+
+// spanBatcher exports the finished spans in batches, in the background. The spans are dropped
+// when the queue is full, and once the batcher is closed.
+type spanBatcher struct {
+	export func(spans []*span) error
+	queue  chan *span
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+var spanExporter *spanBatcher
+
+func newSpanBatcher(export func([]*span) error) *spanBatcher {
+	b := &spanBatcher{export: export, queue: make(chan *span, spanQueueSize), stop: make(chan struct{}), done: make(chan struct{})}
+	go b.run()
+	return b
+}
+
+func (b *spanBatcher) enqueue(s *span) {
+	select {
+	case b.queue <- s:
+	default:
+	}
+}
+
+func (b *spanBatcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, spanBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.export(batch); err != nil {
+			log.Warnf("Cannot export %d spans: %v", len(batch), err)
+		}
+		batch = make([]*span, 0, spanBatchSize)
+	}
+	for {
+		select {
+		case s := <-b.queue:
+			batch = append(batch, s)
+			if len(batch) >= spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-b.stop:
+			// Export the spans finished before close
+			for len(b.queue) > 0 {
+				batch = append(batch, <-b.queue)
+				if len(batch) >= spanBatchSize {
+					flush()
+				}
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// close exports the pending spans
+func (b *spanBatcher) close() {
+	close(b.stop)
+	<-b.done
+}
+
+// OTLP/JSON encoding of the spans, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"` // 2: error
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttribute(key string, value string) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	kv.Value.StringValue = value
+	return kv
+}
+
+func newOTLPSpan(s *span) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceId:           hex.EncodeToString(s.traceId[:]),
+		SpanId:            hex.EncodeToString(s.spanId[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentId != [8]byte{} {
+		o.ParentSpanId = hex.EncodeToString(s.parentId[:])
+	}
+	for _, attribute := range s.attributes {
+		o.Attributes = append(o.Attributes, otlpAttribute(attribute[0], attribute[1]))
+	}
+	if s.err != "" {
+		o.Status.Code, o.Status.Message = 2, s.err
+	}
+	return o
+}
+
+// otlpTraces returns the OTLP/JSON export request of spans
+func otlpTraces(serviceName string, spans []*span) ([]byte, error) {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		otlpSpans[i] = newOTLPSpan(s)
+	}
+	type scope struct {
+		Name string `json:"name"`
+	}
+	type scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	type resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	return json.Marshal(map[string][]resourceSpans{"resourceSpans": {{
+		Resource:   resource{Attributes: []otlpKeyValue{otlpAttribute("service.name", serviceName)}},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: "web3url-gateway"}, Spans: otlpSpans}},
+	}}})
+}
+
+// exportOTLP returns the exporter of the spans to an OTLP/HTTP collector
+func exportOTLP(endpoint string, headers map[string]string, serviceName string) func([]*span) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(spans []*span) error {
+		body, err := otlpTraces(serviceName, spans)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// exportStdout returns the exporter printing the spans, one JSON object per line
+func exportStdout(w io.Writer) func([]*span) error {
+	encoder := json.NewEncoder(w)
+	return func(spans []*span) error {
+		for _, s := range spans {
+			if err := encoder.Encode(newOTLPSpan(s)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func validateTracing() error {
+	switch config.Tracing.Exporter {
+	case "", tracingExporterOTLP, tracingExporterStdout, tracingExporterNone:
+		return nil
+	}
+	return fmt.Errorf("unknown tracing Exporter %v, expected %v, %v or %v", config.Tracing.Exporter, tracingExporterOTLP, tracingExporterStdout, tracingExporterNone)
+}
+
+func initTracing() {
+	cfg := config.Tracing
+	switch cfg.Exporter {
+	case tracingExporterOTLP:
+		spanExporter = newSpanBatcher(exportOTLP(stringOr(cfg.OTLPEndpoint, defaultOTLPEndpoint), cfg.OTLPHeaders, stringOr(cfg.ServiceName, "web3url-gateway")))
+	case tracingExporterStdout:
+		spanExporter = newSpanBatcher(exportStdout(os.Stdout))
+	}
+}
+
+// shutdownTracing exports the pending spans
+func shutdownTracing() {
+	if spanExporter != nil {
+		spanExporter.close()
+	}
+}
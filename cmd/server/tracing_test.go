@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceparent(t *testing.T) {
+	sc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.True(t, sc.sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.traceparent())
+
+	sc, ok = parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, ok)
+	assert.False(t, sc.sampled)
+
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		_, ok := parseTraceparent(header)
+		assert.False(t, ok, header)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	defer func(exporter *spanBatcher) { spanExporter = exporter }(spanExporter)
+
+	// Disabled tracing
+	spanExporter = nil
+	_, disabled := startSpan(context.Background(), "disabled", spanKindInternal)
+	assert.Nil(t, disabled)
+	disabled.set("key", "value")
+	disabled.finish()
+
+	exported := make(chan []*span, 1)
+	spanExporter = newSpanBatcher(func(spans []*span) error {
+		exported <- spans
+		return nil
+	})
+
+	// The trace of the caller is continued, and passed on to the RPC calls
+	req := httptest.NewRequest("GET", "http://vitalik.eth.1.w3link.io/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := startServerSpan(req, "GET")
+	childCtx, child := startSpan(ctx, "rpc eth_call", spanKindClient)
+	child.fail(io.ErrUnexpectedEOF)
+	outbound, _ := http.NewRequest("POST", "http://rpc", nil)
+	injectTraceparent(childCtx, outbound)
+	child.finish()
+	root.finish()
+	spanExporter.close()
+
+	spans := <-exported
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", newOTLPSpan(root).TraceId)
+	assert.Equal(t, "00f067aa0ba902b7", newOTLPSpan(root).ParentSpanId)
+	assert.Equal(t, root.traceId, child.traceId)
+	assert.Equal(t, root.spanId, child.parentId)
+	assert.Equal(t, child.traceparent(), outbound.Header.Get("traceparent"))
+	assert.Equal(t, 2, newOTLPSpan(child).Status.Code)
+
+	// The traces not sampled by the caller are not exported
+	spanExporter = newSpanBatcher(func(spans []*span) error {
+		exported <- spans
+		return nil
+	})
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, root = startServerSpan(req, "GET")
+	root.finish()
+	spanExporter.close()
+	assert.Len(t, exported, 0)
+}
+
+func TestExportOTLP(t *testing.T) {
+	var body map[string]interface{}
+	var auth string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth = req.Header.Get("Authorization")
+		data, _ := io.ReadAll(req.Body)
+		assert.NoError(t, json.Unmarshal(data, &body))
+	}))
+	defer collector.Close()
+
+	s := &span{name: "lookupCname", kind: spanKindInternal}
+	s.traceId[0], s.spanId[0] = 1, 2
+	s.set("dns.cname", "example.eth.1.w3link.io.")
+	export := exportOTLP(collector.URL, map[string]string{"Authorization": "Bearer token"}, "gateway")
+	assert.NoError(t, export([]*span{s}))
+	assert.Equal(t, "Bearer token", auth)
+
+	resourceSpans := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource, _ := json.Marshal(resourceSpans["resource"])
+	assert.Contains(t, string(resource), `"stringValue":"gateway"`)
+	spans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	exported := spans[0].(map[string]interface{})
+	assert.Equal(t, "lookupCname", exported["name"])
+	assert.Equal(t, "01000000000000000000000000000000", exported["traceId"])
+	assert.Equal(t, "0200000000000000", exported["spanId"])
+	assert.Nil(t, exported["parentSpanId"])
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, exportStdout(out)([]*span{s}))
+	assert.Contains(t, out.String(), `"name":"lookupCname"`)
+}
+
+func TestRPCMethod(t *testing.T) {
+	method, to := rpcMethod([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0x00000000000c2e074ec69a0dfb2997ba6c7d2e1e","data":"0x0178b8bf"},"latest"]}`))
+	assert.Equal(t, "eth_call", method)
+	assert.Equal(t, "0x00000000000c2e074ec69a0dfb2997ba6c7d2e1e", to)
+	method, to = rpcMethod([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]}`))
+	assert.Equal(t, "eth_chainId", method)
+	assert.Equal(t, "", to)
+	method, _ = rpcMethod([]byte(` [{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]}]`))
+	assert.Equal(t, "batch", method)
+}